@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+// variableCommands are the terraform subcommands which accept -var and
+// -var-file.
+var variableCommands = []string{"apply", "console", "destroy", "import", "plan", "refresh"}
+
+// subcommand finds the terraform subcommand in args, skipping any global
+// options before it, and returns it along with its position.
+func subcommand(args []string) (string, int) {
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg, i
+		}
+	}
+	return "", -1
+}
+
+// isDestroy reports whether args tear infrastructure down, either with
+// terraform destroy or with the -destroy flag of plan and apply.
+func isDestroy(args []string) bool {
+	name, i := subcommand(args)
+	switch name {
+	case "destroy":
+		return true
+	case "plan", "apply":
+		for _, arg := range args[i+1:] {
+			if arg == "-destroy" || arg == "-destroy=true" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isInit reports whether args initialise workspaces.
+func isInit(args []string) bool {
+	name, _ := subcommand(args)
+	return name == "init"
+}
+
+// reverse decides whether to run in teardown order. The --reverse and
+// --forward flags win over what the terraform command implies.
+func (o Options) reverse(args []string) (bool, error) {
+	switch {
+	case o.Reverse && o.Forward:
+		return false, fmt.Errorf("reverse and forward cannot be used together")
+	case o.Reverse:
+		return true, nil
+	case o.Forward:
+		return false, nil
+	}
+	return isDestroy(args), nil
+}
+
+// workspaceArgs adds the arguments the manifest gives a workspace right after
+// the terraform subcommand. Variables are only added for subcommands which
+// accept them and never when applying a saved plan, which terraform refuses.
+func workspaceArgs(ws terrallel.Workspace, args []string, savedPlan bool) []string {
+	name, i := subcommand(args)
+	if name == "" {
+		return args
+	}
+	extra := append([]string{}, ws.Args[name]...)
+	if slices.Contains(variableCommands, name) && !savedPlan {
+		for _, file := range ws.VarFiles {
+			extra = append(extra, "-var-file="+file)
+		}
+		var keys []string
+		for key := range ws.Vars {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			extra = append(extra, fmt.Sprintf("-var=%s=%s", key, ws.Vars[key]))
+		}
+	}
+	if len(extra) == 0 {
+		return args
+	}
+	merged := append([]string{}, args[:i+1]...)
+	merged = append(merged, extra...)
+	return append(merged, args[i+1:]...)
+}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+func TestIsDestroy(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		expected bool
+	}{
+		"destroy":                       {args: []string{"destroy", "-auto-approve"}, expected: true},
+		"apply":                         {args: []string{"apply", "-auto-approve"}},
+		"apply -destroy":                {args: []string{"apply", "-destroy"}, expected: true},
+		"plan -destroy=true":            {args: []string{"plan", "-destroy=true"}, expected: true},
+		"plan -destroy=false":           {args: []string{"plan", "-destroy=false"}},
+		"global options before destroy": {args: []string{"-chdir=x", "destroy"}, expected: true},
+		"destroy as a variable value":   {args: []string{"apply", "-var", "x=destroy"}},
+		"destroy flag on another":       {args: []string{"init", "-destroy"}},
+		"nothing":                       {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if actual := isDestroy(tc.args); actual != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestOptionsReverse(t *testing.T) {
+	tests := map[string]struct {
+		opts        Options
+		args        []string
+		expected    bool
+		expectedErr string
+	}{
+		"apply runs forward": {
+			args: []string{"apply"},
+		},
+		"destroy runs in reverse": {
+			args:     []string{"destroy"},
+			expected: true,
+		},
+		"reverse wins over apply": {
+			opts:     Options{Options: terrallel.Options{Reverse: true}},
+			args:     []string{"apply"},
+			expected: true,
+		},
+		"forward wins over destroy": {
+			opts: Options{Forward: true},
+			args: []string{"destroy"},
+		},
+		"reverse and forward together": {
+			opts:        Options{Options: terrallel.Options{Reverse: true}, Forward: true},
+			args:        []string{"apply"},
+			expectedErr: "reverse and forward cannot be used together",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := tc.opts.reverse(tc.args)
+			actualErr := ""
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if actualErr != tc.expectedErr {
+				t.Fatalf("expected error %q, got %q", tc.expectedErr, actualErr)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWorkspaceArgs(t *testing.T) {
+	ws := terrallel.Workspace{
+		Path: "dev/network",
+		Args: map[string][]string{
+			"plan":    {"-lock=false"},
+			"apply":   {"-parallelism=5"},
+			"destroy": {"-refresh=false"},
+		},
+		VarFiles: []string{"dev.tfvars"},
+		Vars:     map[string]string{"region": "us-east-1", "cidr": "10.0.0.0/16"},
+	}
+	tests := map[string]struct {
+		args      []string
+		savedPlan bool
+		expected  []string
+	}{
+		"plan": {
+			args:     []string{"plan", "-out=x.tfplan"},
+			expected: []string{"plan", "-lock=false", "-var-file=dev.tfvars", "-var=cidr=10.0.0.0/16", "-var=region=us-east-1", "-out=x.tfplan"},
+		},
+		"apply": {
+			args:     []string{"apply", "-auto-approve"},
+			expected: []string{"apply", "-parallelism=5", "-var-file=dev.tfvars", "-var=cidr=10.0.0.0/16", "-var=region=us-east-1", "-auto-approve"},
+		},
+		"destroy": {
+			args:     []string{"destroy"},
+			expected: []string{"destroy", "-refresh=false", "-var-file=dev.tfvars", "-var=cidr=10.0.0.0/16", "-var=region=us-east-1"},
+		},
+		"applying a saved plan": {
+			args:      []string{"apply", "-input=false", "x.tfplan"},
+			savedPlan: true,
+			expected:  []string{"apply", "-parallelism=5", "-input=false", "x.tfplan"},
+		},
+		"global options before the subcommand": {
+			args:     []string{"-chdir=x", "plan"},
+			expected: []string{"-chdir=x", "plan", "-lock=false", "-var-file=dev.tfvars", "-var=cidr=10.0.0.0/16", "-var=region=us-east-1"},
+		},
+		"subcommand without variables": {
+			args:     []string{"init", "-upgrade"},
+			expected: []string{"init", "-upgrade"},
+		},
+		"no subcommand": {
+			args:     []string{"-version"},
+			expected: []string{"-version"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual := workspaceArgs(ws, tc.args, tc.savedPlan)
+			if diff := cmp.Diff(tc.expected, actual); diff != "" {
+				t.Errorf("args mismatch (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
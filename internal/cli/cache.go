@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scaleoutllc/terrallel/internal/terraform"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+// pluginCacheEnv is the variable terraform reads its plugin cache from.
+const pluginCacheEnv = "TF_PLUGIN_CACHE_DIR"
+
+// pluginCache returns the absolute path of the shared plugin cache so it can
+// be found from every workspace, creating it unless this is a dry run.
+func pluginCache(dir string, dryrun bool) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("plugin cache: %w", err)
+	}
+	if dryrun {
+		return abs, nil
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return "", fmt.Errorf("plugin cache: %w", err)
+	}
+	return abs, nil
+}
+
+// warmers picks one workspace for every distinct lock file among the
+// workspaces given, keyed by name with their directories. Running init in
+// those first fills the plugin cache with every provider needed before the
+// rest start, so no two workspaces race to install the same provider into
+// it. A workspace without a lock file could need any provider, so every one
+// of them is picked.
+func warmers(dirs map[string]string) (map[string]bool, error) {
+	var names []string
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := map[string]bool{}
+	picked := map[string]bool{}
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(dirs[name], ".terraform.lock.hcl"))
+		if errors.Is(err, fs.ErrNotExist) {
+			picked[name] = true
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading lock file of %s: %w", name, err)
+		}
+		sum := sha256.Sum256(content)
+		key := hex.EncodeToString(sum[:])
+		if !seen[key] {
+			seen[key] = true
+			picked[name] = true
+		}
+	}
+	return picked, nil
+}
+
+// warmUp runs init one at a time ahead of the run in those of the given
+// workspaces which would otherwise be initialised by --auto-init, in parallel
+// with every other workspace sharing the plugin cache.
+func warmUp(jobs map[string]workspaceJob, names map[string]bool, dirs map[string]string, stopWait time.Duration) error {
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	warm := &terrallel.Tree{}
+	first := map[terrallel.Job]bool{}
+	for _, name := range sorted {
+		job, ok := jobs[name].(*terraform.Job)
+		if !ok || !job.AutoInit || job.Backend.ManagesInit() {
+			continue
+		}
+		if reason, _ := terraform.NeedsInit(dirs[name]); reason == "" {
+			continue
+		}
+		initJob := &terraform.Job{
+			Name:              job.Name,
+			Workspace:         job.Workspace,
+			Basedir:           job.Basedir,
+			Bin:               job.Bin,
+			Backend:           job.Backend,
+			Args:              append([]string{}, terraform.InitArgs...),
+			Retry:             job.Retry,
+			Timeout:           job.Timeout,
+			Grace:             job.Grace,
+			GraceTimeoutsOnly: job.GraceTimeoutsOnly,
+			Env:               job.Env,
+			Stdout:            job.Stdout,
+			Stderr:            job.Stderr,
+		}
+		warm.Jobs = append(warm.Jobs, initJob)
+		first[initJob] = true
+	}
+	if len(warm.Jobs) == 0 {
+		return nil
+	}
+	fmt.Printf("Filling the plugin cache from %d workspaces first\n", len(warm.Jobs))
+	if err := warm.Do(terrallel.Options{First: first, StopWait: stopWait}); err != nil {
+		return fmt.Errorf("filling the plugin cache: %w", err)
+	}
+	return nil
+}
+
+// cacheSavings measures how much disk the plugin cache saved across the
+// directories of the given workspaces. Terraform links providers found in the
+// cache into .terraform rather than copying them, so every link beyond the
+// first to the same provider is a copy which was never downloaded or written.
+func cacheSavings(cache string, dirs map[string]string) (int64, int, error) {
+	cache, err := filepath.EvalSymlinks(cache)
+	if err != nil {
+		return 0, 0, fmt.Errorf("measuring plugin cache: %w", err)
+	}
+	linked := map[string]int{}
+	// workspaces sharing a directory under different terraform workspaces
+	// share its .terraform too.
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		root := filepath.Join(dir, ".terraform", "providers")
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || entry.Type()&fs.ModeSymlink == 0 {
+				return err
+			}
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				// a dangling link saves nothing.
+				return nil
+			}
+			if strings.HasPrefix(target, cache+string(filepath.Separator)) {
+				linked[target]++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("measuring plugin cache: %w", err)
+		}
+	}
+	var saved int64
+	providers := 0
+	for target, links := range linked {
+		size, err := dirSize(target)
+		if err != nil {
+			return 0, 0, fmt.Errorf("measuring plugin cache: %w", err)
+		}
+		saved += size * int64(links-1)
+		providers++
+	}
+	return saved, providers, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// printCacheSavings reports how much the plugin cache saved.
+func printCacheSavings(out io.Writer, cache string, dirs map[string]string) {
+	saved, providers, err := cacheSavings(cache, dirs)
+	if err != nil {
+		fmt.Fprintf(out, "\n%s\n", err)
+		return
+	}
+	plural := "s"
+	if providers == 1 {
+		plural = ""
+	}
+	fmt.Fprintf(out, "\nPlugin cache %s: %d provider%s shared, %s saved\n", cache, providers, plural, formatBytes(saved))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWarmers(t *testing.T) {
+	basedir := t.TempDir()
+	locks := map[string]string{
+		"aws/network": `provider "registry.terraform.io/hashicorp/aws" {}`,
+		"aws/cluster": `provider "registry.terraform.io/hashicorp/aws" {}`,
+		"gcp/network": `provider "registry.terraform.io/hashicorp/google" {}`,
+		"new/one":     "",
+		"new/two":     "",
+	}
+	dirs := map[string]string{}
+	for name, lock := range locks {
+		dir := filepath.Join(basedir, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if lock != "" {
+			if err := os.WriteFile(filepath.Join(dir, ".terraform.lock.hcl"), []byte(lock), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dirs[name] = dir
+	}
+	picked, err := warmers(dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for name := range picked {
+		actual = append(actual, name)
+	}
+	sort.Strings(actual)
+	expected := []string{"aws/cluster", "gcp/network", "new/one", "new/two"}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("warmers mismatch (-expected +actual):\n%s", diff)
+	}
+}
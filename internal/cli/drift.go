@@ -0,0 +1,155 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+// driftReport mirrors the tree of a target with what drifted in each of its
+// workspaces.
+type driftReport struct {
+	Name       string           `json:"name"`
+	Groups     []*driftReport   `json:"groups,omitempty"`
+	Workspaces []driftWorkspace `json:"workspaces,omitempty"`
+	Next       *driftReport     `json:"next,omitempty"`
+}
+
+type driftWorkspace struct {
+	Path    string   `json:"path"`
+	Status  string   `json:"status"`
+	Drifted []string `json:"drifted"`
+}
+
+// Drift runs a refresh-only plan in every workspace of the target at once
+// and reports which resources changed outside of terraform. The report is
+// written as JSON to jsonPath, or next to the plans when that is empty.
+func Drift(manifestPath string, targetName string, args []string, jsonPath string, opts Options) error {
+	name := fmt.Sprintf("%s-%s", targetName, time.Now().Format("20060102-150405"))
+	dir, err := filepath.Abs(filepath.Join(filepath.Dir(manifestPath), ".terrallel", "drift", name))
+	if err != nil {
+		return err
+	}
+	if jsonPath == "" {
+		jsonPath = filepath.Join(dir, "drift.json")
+	}
+	if !opts.DryRun {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating drift directory: %w", err)
+		}
+	}
+	opts.Unordered = true
+	flags := append([]string{"plan", "-refresh-only", "-detailed-exitcode", "-input=false"}, args...)
+	var report *driftReport
+	_, err = run(manifestPath, targetName, command{
+		args:     flags,
+		readOnly: true,
+		workspaceArgs: func(workspace string) []string {
+			return append(append([]string{}, flags...), "-out="+filepath.Join(dir, planFile(workspace)))
+		},
+		plan: func(workspace string) string {
+			return filepath.Join(dir, planFile(workspace))
+		},
+		report: func(runner *terrallel.Tree, jobs map[string]workspaceJob) {
+			names := map[terrallel.Job]string{}
+			for name, job := range jobs {
+				names[job] = name
+			}
+			report = newDriftReport(runner, jobs, names)
+			printDriftTable(os.Stdout, report)
+		},
+	}, opts, nil)
+	if report == nil {
+		return err
+	}
+	content, jsonErr := json.MarshalIndent(report, "", "  ")
+	if jsonErr == nil {
+		jsonErr = os.WriteFile(jsonPath, append(content, '\n'), 0o644)
+	}
+	if jsonErr != nil {
+		return fmt.Errorf("writing drift report: %w", jsonErr)
+	}
+	fmt.Printf("\nWrote drift report to %s\n", jsonPath)
+	return err
+}
+
+func newDriftReport(t *terrallel.Tree, jobs map[string]workspaceJob, names map[terrallel.Job]string) *driftReport {
+	report := &driftReport{Name: t.Name}
+	for _, g := range t.Group {
+		report.Groups = append(report.Groups, newDriftReport(g, jobs, names))
+	}
+	for _, job := range t.Jobs {
+		name := names[job]
+		record := jobs[name].Record()
+		ws := driftWorkspace{Path: name, Status: driftStatus(record.Status), Drifted: []string{}}
+		if record.Plan != nil && len(record.Plan.Drifted) != 0 {
+			ws.Drifted = record.Plan.Drifted
+		}
+		report.Workspaces = append(report.Workspaces, ws)
+	}
+	if t.Next != nil {
+		report.Next = newDriftReport(t.Next, jobs, names)
+	}
+	return report
+}
+
+// driftStatus describes the outcome of a refresh-only plan with
+// -detailed-exitcode in terms of drift.
+func driftStatus(status string) string {
+	switch status {
+	case "changes":
+		return "drifted"
+	case "no-changes":
+		return "in-sync"
+	}
+	return status
+}
+
+// workspaces lists every workspace in the report once.
+func (r *driftReport) workspaces(seen map[string]bool) []driftWorkspace {
+	var all []driftWorkspace
+	for _, g := range r.Groups {
+		all = append(all, g.workspaces(seen)...)
+	}
+	for _, ws := range r.Workspaces {
+		if !seen[ws.Path] {
+			seen[ws.Path] = true
+			all = append(all, ws)
+		}
+	}
+	if r.Next != nil {
+		all = append(all, r.Next.workspaces(seen)...)
+	}
+	return all
+}
+
+// printDriftTable writes a table of every workspace with how many resources
+// drifted in it followed by the drifted resources.
+func printDriftTable(w io.Writer, report *driftReport) {
+	all := report.workspaces(map[string]bool{})
+	sort.Slice(all, func(i, j int) bool { return all[i].Path < all[j].Path })
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w)
+	fmt.Fprintln(table, "WORKSPACE\tSTATUS\tDRIFTED")
+	var drifted []string
+	for _, ws := range all {
+		fmt.Fprintf(table, "%s\t%s\t%d\n", ws.Path, ws.Status, len(ws.Drifted))
+		for _, address := range ws.Drifted {
+			drifted = append(drifted, fmt.Sprintf("%s: %s", ws.Path, address))
+		}
+	}
+	table.Flush()
+	if len(drifted) != 0 {
+		fmt.Fprintf(w, "\n%s\n", color.YellowString("Resources changed outside of terraform:"))
+		fmt.Fprintf(w, "  %s\n", strings.Join(drifted, "\n  "))
+	}
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/scaleoutllc/terrallel/internal/terraform"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+// journal records the outcome of every workspace in the last run against a
+// manifest so a failed run can be picked up again. Kind is plan or apply for
+// a run which saved plans into PlanDir or applied them from it. Args has the
+// values of secret variables masked, so a run given any can't be retried from
+// the journal alone.
+type journal struct {
+	Target     string                      `json:"target"`
+	Args       []string                    `json:"args"`
+	Exec       bool                        `json:"exec,omitempty"`
+	Kind       string                      `json:"kind,omitempty"`
+	PlanDir    string                      `json:"plan_dir,omitempty"`
+	Reverse    bool                        `json:"reverse"`
+	Selection  Selection                   `json:"selection"`
+	Basedir    string                      `json:"basedir"`
+	Started    time.Time                   `json:"started"`
+	Finished   time.Time                   `json:"finished"`
+	Workspaces map[string]terraform.Record `json:"workspaces"`
+}
+
+// journalPath is where the journal for a manifest is kept.
+func journalPath(manifestPath string) string {
+	return filepath.Join(filepath.Dir(manifestPath), ".terrallel", "journal.json")
+}
+
+// readJournal loads the journal at path. A missing journal is not an error
+// and results in nil.
+func readJournal(path string) (*journal, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+	j := &journal{}
+	if err := json.Unmarshal(content, j); err != nil {
+		return nil, fmt.Errorf("parsing journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+func (j *journal) write(path string) error {
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	// write beside the journal and rename so an interrupted write never
+	// leaves a partial journal behind.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(content, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return nil
+}
+
+// matches reports whether the journal is of a run of the same target and
+// command over the same selection.
+func (j *journal) matches(target string, args []string, selection Selection) bool {
+	return j.Target == target && slices.Equal(j.Args, terraform.MaskArgs(args)) && j.Selection.equal(selection)
+}
+
+func (j *journal) succeeded(workspace string) (terraform.Record, bool) {
+	record, ok := j.Workspaces[workspace]
+	return record, ok && record.Succeeded()
+}
+
+// leftOut reports whether the run left the workspace out on purpose, so it
+// neither succeeded nor needs to be run again.
+func (j *journal) leftOut(workspace string) bool {
+	record, ok := j.Workspaces[workspace]
+	return ok && (record.Status == notSelected || record.Status == "excluded")
+}
+
+// workspaceJob is a job run for a workspace which can be kept in the journal.
+type workspaceJob interface {
+	terrallel.Job
+	Record() terraform.Record
+}
+
+// resumed stands in for a workspace which succeeded in the run being
+// resumed so it is not run again.
+type resumed struct {
+	name   string
+	record terraform.Record
+	stdout io.Writer
+}
+
+func (r *resumed) Run(dryrun bool) error {
+	fmt.Fprintf(r.stdout, "[%s]: %s\n", r.name, color.GreenString("succeeded in previous run, skipping"))
+	return nil
+}
+
+func (r *resumed) Cancel() error {
+	return nil
+}
+
+func (r *resumed) Result() string {
+	return fmt.Sprintf("%s: %s", r.name, color.GreenString("success (resumed)"))
+}
+
+func (r *resumed) Record() terraform.Record {
+	return r.record
+}
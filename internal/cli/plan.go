@@ -0,0 +1,320 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/scaleoutllc/terrallel/internal/terraform"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+// planSet records the plans saved by a plan run so exactly those can be
+// applied later.
+type planSet struct {
+	Target     string               `json:"target"`
+	Args       []string             `json:"args"`
+	Reverse    bool                 `json:"reverse"`
+	Created    time.Time            `json:"created"`
+	Workspaces map[string]savedPlan `json:"workspaces"`
+}
+
+// savedPlan is the plan file of a workspace along with a fingerprint of the
+// configuration it was made from.
+type savedPlan struct {
+	File        string `json:"file"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+const planSetFile = "plans.json"
+
+// Plan saves a plan for every workspace of the target into planDir. When
+// planDir is empty a new directory is made for the run next to the journal.
+func Plan(manifestPath string, targetName string, args []string, planDir string, opts Options) error {
+	if planDir == "" {
+		name := fmt.Sprintf("%s-%s", targetName, time.Now().Format("20060102-150405"))
+		planDir = filepath.Join(filepath.Dir(manifestPath), ".terrallel", "plans", name)
+	}
+	return savePlans(manifestPath, targetName, args, planDir, opts, nil)
+}
+
+// savePlans runs Plan. When a previous plan run is given, only the
+// workspaces which failed in it are planned again and the rest keep the plans
+// already saved for them.
+func savePlans(manifestPath string, targetName string, args []string, planDir string, opts Options, previous *journal) error {
+	planDir, err := filepath.Abs(planDir)
+	if err != nil {
+		return err
+	}
+	if !opts.DryRun {
+		if err := os.MkdirAll(planDir, 0o755); err != nil {
+			return fmt.Errorf("creating plan directory: %w", err)
+		}
+	}
+	reverse, err := opts.reverse(append([]string{"plan"}, args...))
+	if err != nil {
+		return err
+	}
+	var dirs map[string]string
+	kept := map[string]bool{}
+	record, err := run(manifestPath, targetName, command{
+		args:    append([]string{"plan"}, args...),
+		kind:    "plan",
+		planDir: planDir,
+		workspaceArgs: func(workspace string) []string {
+			out := "-out=" + filepath.Join(planDir, planFile(workspace))
+			return append([]string{"plan", "-input=false", out}, args...)
+		},
+		plan: func(workspace string) string {
+			return filepath.Join(planDir, planFile(workspace))
+		},
+		check: func(workspaces map[string]string) error {
+			dirs = workspaces
+			return nil
+		},
+		report: func(runner *terrallel.Tree, jobs map[string]workspaceJob) {
+			for name, job := range jobs {
+				if _, ok := job.(*resumed); ok {
+					kept[name] = true
+				}
+			}
+		},
+	}, opts, previous)
+	if record == nil {
+		return err
+	}
+	// failing to save the plans outweighs the changes they hold.
+	runErr := err
+	if runErr == ErrChanges {
+		runErr = nil
+	}
+	existing := &planSet{}
+	if len(kept) != 0 {
+		var readErr error
+		if existing, readErr = readPlanSet(planDir); readErr != nil {
+			return errors.Join(runErr, readErr)
+		}
+	}
+	set := &planSet{
+		Target:     targetName,
+		Args:       terraform.MaskArgs(args),
+		Reverse:    reverse,
+		Created:    time.Now(),
+		Workspaces: map[string]savedPlan{},
+	}
+	var fingerprintErr error
+	var failed []string
+	for name, workspace := range record.Workspaces {
+		if saved, ok := existing.Workspaces[name]; ok && kept[name] {
+			set.Workspaces[name] = saved
+			continue
+		}
+		if record.leftOut(name) {
+			continue
+		}
+		if !workspace.Succeeded() {
+			failed = append(failed, name)
+			continue
+		}
+		fingerprint, ferr := fingerprint(dirs[name])
+		fingerprintErr = errors.Join(fingerprintErr, ferr)
+		set.Workspaces[name] = savedPlan{File: planFile(name), Fingerprint: fingerprint}
+	}
+	if fingerprintErr != nil {
+		return errors.Join(runErr, fingerprintErr)
+	}
+	if writeErr := set.write(planDir); writeErr != nil {
+		return errors.Join(runErr, writeErr)
+	}
+	sort.Strings(failed)
+	printPlanSummary(os.Stdout, record)
+	fmt.Printf("\nSaved %d plans to %s\n", len(set.Workspaces), planDir)
+	if len(failed) != 0 {
+		fmt.Printf("No plan was saved for %s\n", strings.Join(failed, ", "))
+	} else {
+		fmt.Printf("Apply them with: terrallel apply %s --plan-dir %s\n", targetName, planDir)
+	}
+	return err
+}
+
+// Apply applies the plans saved by Plan in dependency order. Nothing is
+// applied when the plan of any workspace to be run is missing or was made
+// from configuration which has changed since.
+func Apply(manifestPath string, targetName string, args []string, planDir string, opts Options) error {
+	return applyPlans(manifestPath, targetName, args, planDir, opts, nil)
+}
+
+// applyPlans runs Apply. When a previous apply run is given, only the
+// workspaces which failed in it and what depends on them are applied.
+func applyPlans(manifestPath string, targetName string, args []string, planDir string, opts Options, previous *journal) error {
+	planDir, err := filepath.Abs(planDir)
+	if err != nil {
+		return err
+	}
+	set, err := readPlanSet(planDir)
+	if err != nil {
+		return err
+	}
+	if set.Target != targetName {
+		return fmt.Errorf("plans in %s are for %s, not %s", planDir, set.Target, targetName)
+	}
+	if !opts.Forward && set.Reverse {
+		opts.Reverse = true
+	}
+	_, err = run(manifestPath, targetName, command{
+		args:      append([]string{"apply"}, args...),
+		kind:      "apply",
+		planDir:   planDir,
+		savedPlan: true,
+		workspaceArgs: func(workspace string) []string {
+			file := filepath.Join(planDir, set.Workspaces[workspace].File)
+			return append(append([]string{"apply", "-input=false"}, args...), file)
+		},
+		check: func(dirs map[string]string) error {
+			return set.check(planDir, dirs)
+		},
+	}, opts, previous)
+	return err
+}
+
+// printPlanSummary writes a table of the changes planned in every workspace
+// followed by the resources which would be destroyed.
+func printPlanSummary(w io.Writer, record *journal) {
+	var names []string
+	for name, workspace := range record.Workspaces {
+		if workspace.Plan != nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	total := terraform.PlanSummary{}
+	var destroyed []string
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w)
+	fmt.Fprintln(table, "WORKSPACE\tADD\tCHANGE\tDESTROY")
+	for _, name := range names {
+		plan := record.Workspaces[name].Plan
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\n", name, plan.Add, plan.Change, plan.Destroy)
+		total.Add += plan.Add
+		total.Change += plan.Change
+		total.Destroy += plan.Destroy
+		for _, address := range plan.Destroyed {
+			destroyed = append(destroyed, fmt.Sprintf("%s: %s", name, address))
+		}
+	}
+	fmt.Fprintf(table, "TOTAL\t%d\t%d\t%d\n", total.Add, total.Change, total.Destroy)
+	table.Flush()
+	if len(destroyed) != 0 {
+		fmt.Fprintf(w, "\n%s\n", color.RedString("Resources to be destroyed:"))
+		for _, resource := range destroyed {
+			fmt.Fprintf(w, "  %s %s\n", color.RedString("-"), resource)
+		}
+	}
+}
+
+// check refuses plans which are missing or stale for any of the workspaces,
+// given by name with their directories.
+func (s *planSet) check(planDir string, dirs map[string]string) error {
+	var names []string
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		plan, ok := s.Workspaces[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: no plan was saved", name))
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(planDir, plan.File)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: plan file is missing", name))
+			continue
+		}
+		current, err := fingerprint(dirs[name])
+		if err != nil {
+			return err
+		}
+		if current != plan.Fingerprint {
+			problems = append(problems, fmt.Sprintf("%s: plan is stale, configuration changed since it was made", name))
+		}
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("refusing to apply plans from %s\n%s", planDir, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func (s *planSet) write(planDir string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writing plans: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(planDir, planSetFile), append(content, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing plans: %w", err)
+	}
+	return nil
+}
+
+func readPlanSet(planDir string) (*planSet, error) {
+	content, err := os.ReadFile(filepath.Join(planDir, planSetFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no saved plans in %s", planDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading plans: %w", err)
+	}
+	set := &planSet{}
+	if err := json.Unmarshal(content, set); err != nil {
+		return nil, fmt.Errorf("parsing plans in %s: %w", planDir, err)
+	}
+	return set, nil
+}
+
+// planFile is the name of the plan file for a workspace within the plan
+// directory. The workspace is escaped rather than flattened so no two
+// workspaces share a file.
+func planFile(workspace string) string {
+	return url.PathEscape(workspace) + ".tfplan"
+}
+
+// fingerprint hashes the configuration, variable and lock files at the top
+// level of a workspace. Changes to modules elsewhere are left to terraform,
+// which refuses to apply a plan made against different state.
+func fingerprint(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("fingerprinting %s: %w", dir, err)
+	}
+	hash := sha256.New()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(name == ".terraform.lock.hcl" ||
+			strings.HasSuffix(name, ".tf") || strings.HasSuffix(name, ".tf.json") ||
+			strings.HasSuffix(name, ".tfvars") || strings.HasSuffix(name, ".tfvars.json")) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", fmt.Errorf("fingerprinting %s: %w", dir, err)
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(content))
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
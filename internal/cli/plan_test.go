@@ -0,0 +1,361 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPlanFile(t *testing.T) {
+	workspaces := []string{"a/b_c", "a_b/c", "a_b_c", "a/b/c", "a/b@dev", "a/b%40dev", "a/b"}
+	files := map[string]string{}
+	for _, workspace := range workspaces {
+		file := planFile(workspace)
+		if other, ok := files[file]; ok {
+			t.Errorf("%s and %s share the plan file %s", other, workspace, file)
+		}
+		if strings.ContainsAny(file, `/\`) {
+			t.Errorf("plan file %s of %s is not a single file name", file, workspace)
+		}
+		files[file] = workspace
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := map[string]struct {
+		change  func(dir string) error
+		changed bool
+	}{
+		"nothing changed": {
+			change: func(dir string) error { return nil },
+		},
+		"configuration changed": {
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "main.tf"), []byte(`resource "null_resource" "b" {}`), 0o644)
+			},
+			changed: true,
+		},
+		"configuration added": {
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "outputs.tf.json"), []byte(`{}`), 0o644)
+			},
+			changed: true,
+		},
+		"variables changed": {
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "dev.tfvars"), []byte(`region = "eu-west-1"`), 0o644)
+			},
+			changed: true,
+		},
+		"lock file changed": {
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, ".terraform.lock.hcl"), []byte(`# changed`), 0o644)
+			},
+			changed: true,
+		},
+		"configuration renamed": {
+			change: func(dir string) error {
+				return os.Rename(filepath.Join(dir, "main.tf"), filepath.Join(dir, "other.tf"))
+			},
+			changed: true,
+		},
+		"other files changed": {
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "README.md"), []byte(`changed`), 0o644)
+			},
+		},
+		"nested directories changed": {
+			change: func(dir string) error {
+				if err := os.MkdirAll(filepath.Join(dir, "modules", "x"), 0o755); err != nil {
+					return err
+				}
+				return os.WriteFile(filepath.Join(dir, "modules", "x", "main.tf"), []byte(`changed`), 0o644)
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{
+				"main.tf":             `resource "null_resource" "a" {}`,
+				"dev.tfvars":          `region = "us-east-1"`,
+				".terraform.lock.hcl": `# lock`,
+				"README.md":           `readme`,
+			}
+			for file, content := range files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, err := fingerprint(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.change(dir); err != nil {
+				t.Fatal(err)
+			}
+			after, err := fingerprint(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed := before != after; changed != tc.changed {
+				t.Errorf("expected changed to be %t, got %t", tc.changed, changed)
+			}
+		})
+	}
+	if _, err := fingerprint(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected an error fingerprinting a missing workspace")
+	}
+}
+
+func TestPlanSetCheck(t *testing.T) {
+	basedir := t.TempDir()
+	planDir := t.TempDir()
+	dirs := map[string]string{}
+	set := &planSet{Workspaces: map[string]savedPlan{}}
+	for _, name := range []string{"ready", "stale", "missing-file"} {
+		dir := filepath.Join(basedir, name)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		current, err := fingerprint(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.Workspaces[name] = savedPlan{File: planFile(name), Fingerprint: current}
+		dirs[name] = dir
+		if name != "missing-file" {
+			if err := os.WriteFile(filepath.Join(planDir, planFile(name)), []byte("plan"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dirs["unplanned"] = filepath.Join(basedir, "unplanned")
+	if err := os.WriteFile(filepath.Join(dirs["stale"], "main.tf"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		workspaces  []string
+		expectedErr string
+	}{
+		"every plan ready": {
+			workspaces: []string{"ready"},
+		},
+		"nothing to apply": {},
+		"problems with several plans": {
+			workspaces: []string{"ready", "stale", "missing-file", "unplanned"},
+			expectedErr: "refusing to apply plans from " + planDir + "\n" +
+				"missing-file: plan file is missing\n" +
+				"stale: plan is stale, configuration changed since it was made\n" +
+				"unplanned: no plan was saved",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			selected := map[string]string{}
+			for _, workspace := range tc.workspaces {
+				selected[workspace] = dirs[workspace]
+			}
+			err := set.check(planDir, selected)
+			actualErr := ""
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.expectedErr, actualErr); diff != "" {
+				t.Errorf("error mismatch (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
+
+// savedPlanFixture is a manifest of three workspaces, c depending on a and b,
+// run by a stand-in for terraform which logs what it is asked to do. Plans
+// fail in workspaces listed in fail-plan and applies in those listed in
+// fail-apply.
+type savedPlanFixture struct {
+	dir      string
+	manifest string
+	planDir  string
+	opts     Options
+}
+
+func newSavedPlanFixture(t *testing.T) *savedPlanFixture {
+	requireShell(t)
+	dir := t.TempDir()
+	f := &savedPlanFixture{
+		dir:      dir,
+		manifest: filepath.Join(dir, "Infrafile"),
+		planDir:  filepath.Join(dir, "plans"),
+	}
+	manifest := "terrallel:\n" +
+		"  basedir: " + filepath.Join(dir, "ws") + "\n" +
+		"targets:\n" +
+		"  dev:\n" +
+		"    workspaces: [a, b]\n" +
+		"    next:\n" +
+		"      workspaces: [c]\n"
+	script := "#!/bin/sh\n" +
+		"name=$(basename \"$PWD\")\n" +
+		"[ \"$1\" = show ] && echo '{}' && exit 0\n" +
+		"echo \"$name $*\" >> " + filepath.Join(dir, "log") + "\n" +
+		"grep -qx \"$name\" " + filepath.Join(dir, "fail-$1") + " 2>/dev/null && exit 1\n" +
+		"for arg; do case $arg in -out=*) echo plan > \"${arg#-out=}\";; esac; done\n" +
+		"exit 0\n"
+	f.opts = Options{Bin: filepath.Join(dir, "terraform")}
+	files := map[string]string{
+		f.manifest:                         manifest,
+		f.opts.Bin:                         script,
+		filepath.Join(dir, "ws/a/main.tf"): "a",
+		filepath.Join(dir, "ws/b/main.tf"): "b",
+		filepath.Join(dir, "ws/c/main.tf"): "c",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func (f *savedPlanFixture) fail(t *testing.T, command string, workspaces ...string) {
+	content := strings.Join(workspaces, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(f.dir, "fail-"+command), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// log returns what was run since it was last called.
+func (f *savedPlanFixture) log(t *testing.T) []string {
+	path := filepath.Join(f.dir, "log")
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line != "" {
+			lines = append(lines, strings.ReplaceAll(line, f.planDir, "PLANS"))
+		}
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+func TestSavedPlansRetry(t *testing.T) {
+	f := newSavedPlanFixture(t)
+	f.fail(t, "plan", "b")
+	if err := Plan(f.manifest, "dev", []string{"-lock=false"}, f.planDir, f.opts); err == nil {
+		t.Fatalf("expected plan to fail in b")
+	}
+	expected := []string{
+		"a plan -input=false -out=PLANS/a.tfplan -lock=false",
+		"b plan -input=false -out=PLANS/b.tfplan -lock=false",
+	}
+	if diff := cmp.Diff(expected, f.log(t)); diff != "" {
+		t.Errorf("plan mismatch (-expected +actual):\n%s", diff)
+	}
+	set, err := readPlanSet(f.planDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned := set.Workspaces["a"]
+	if _, ok := set.Workspaces["b"]; ok || planned.File != "a.tfplan" {
+		t.Errorf("expected only a plan for a, got %v", set.Workspaces)
+	}
+
+	f.fail(t, "plan")
+	if err := os.WriteFile(filepath.Join(f.dir, "ws/a/main.tf"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RetryFailed(f.manifest, Options{Bin: f.opts.Bin}); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"b plan -input=false -out=PLANS/b.tfplan -lock=false",
+		"c plan -input=false -out=PLANS/c.tfplan -lock=false",
+	}
+	if diff := cmp.Diff(expected, f.log(t)); diff != "" {
+		t.Errorf("retried plan mismatch (-expected +actual):\n%s", diff)
+	}
+	if set, err = readPlanSet(f.planDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Workspaces) != 3 || set.Workspaces["a"] != planned {
+		t.Errorf("expected the plan of a to be kept alongside new ones, got %v", set.Workspaces)
+	}
+
+	f.fail(t, "apply", "a")
+	if err := os.WriteFile(filepath.Join(f.dir, "ws/a/main.tf"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(f.manifest, "dev", nil, f.planDir, f.opts); err == nil {
+		t.Fatalf("expected apply to fail in a")
+	}
+	expected = []string{
+		"a apply -input=false PLANS/a.tfplan",
+		"b apply -input=false PLANS/b.tfplan",
+	}
+	if diff := cmp.Diff(expected, f.log(t)); diff != "" {
+		t.Errorf("apply mismatch (-expected +actual):\n%s", diff)
+	}
+	if err := Root(f.manifest, "dev", []string{"apply"}, Options{Bin: f.opts.Bin, Resume: true}); err == nil {
+		t.Errorf("expected resuming a saved plan apply as a plain apply to be refused")
+	}
+
+	// checking for drift in between leaves the failed apply to be retried.
+	if err := Drift(f.manifest, "dev", nil, filepath.Join(f.dir, "drift.json"), f.opts); err != nil && err != ErrChanges {
+		t.Fatal(err)
+	}
+	f.log(t)
+
+	f.fail(t, "apply")
+	if err := RetryFailed(f.manifest, Options{Bin: f.opts.Bin}); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"a apply -input=false PLANS/a.tfplan",
+		"c apply -input=false PLANS/c.tfplan",
+	}
+	if diff := cmp.Diff(expected, f.log(t)); diff != "" {
+		t.Errorf("retried apply mismatch (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestSavedPlansStale(t *testing.T) {
+	f := newSavedPlanFixture(t)
+	if err := Plan(f.manifest, "dev", nil, f.planDir, f.opts); err != nil {
+		t.Fatal(err)
+	}
+	f.log(t)
+	if err := os.WriteFile(filepath.Join(f.dir, "ws/c/main.tf"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := Apply(f.manifest, "dev", nil, f.planDir, f.opts)
+	if err == nil || !strings.Contains(err.Error(), "c: plan is stale") {
+		t.Errorf("expected the stale plan of c to be refused, got %v", err)
+	}
+	if ran := f.log(t); len(ran) != 0 {
+		t.Errorf("expected nothing to be applied, got %v", ran)
+	}
+}
+
+// requireShell skips tests which stand in for terraform with a POSIX shell
+// script, as windows cannot run them.
+func requireShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+}
@@ -1,45 +1,447 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/scaleoutllc/terrallel/internal/terraform"
 	"github.com/scaleoutllc/terrallel/internal/terrallel"
 )
 
+// ErrChanges is returned by a run which succeeded when any workspace
+// reported changes through -detailed-exitcode.
+var ErrChanges = errors.New("changes are present")
+
+// defaultGrace is how long a timed out job has to exit by itself when neither
+// the command line nor the manifest says otherwise. Without either, jobs
+// stopped for any other reason are never killed.
+const defaultGrace = 30 * time.Second
+
+// Options are the command line settings for a run.
+type Options struct {
+	terrallel.Options
+	// JobTimeout limits how long each workspace may run.
+	JobTimeout time.Duration
+	// Grace is how long a stopped job has to exit before being killed. It is
+	// nil unless set, zero never kills.
+	Grace *time.Duration
+	// Bin is the terraform-compatible program to run in workspaces which
+	// don't name their own.
+	Bin string
+	// PluginCache is a directory every workspace shares as its plugin cache.
+	PluginCache string
+	// AutoInit runs init first in workspaces which need it.
+	AutoInit bool
+	// Forward runs in build order even when the terraform command tears
+	// infrastructure down.
+	Forward bool
+	// Resume skips workspaces which succeeded in the last run when it was of
+	// the same target and command.
+	Resume bool
+	Selection
+}
+
 func Root(
 	manifestPath string,
 	targetName string,
 	args []string,
-	dryrun bool,
+	opts Options,
 ) error {
-	var reverse bool
-	for _, arg := range args {
-		if arg == "destroy" {
-			reverse = true
+	var previous *journal
+	if opts.Resume {
+		var err error
+		if previous, err = readJournal(journalPath(manifestPath)); err != nil {
+			return err
 		}
+		if previous == nil || previous.Exec || previous.Kind != "" || !previous.matches(targetName, args, opts.Selection) {
+			return fmt.Errorf("nothing to resume: the last run was not of %s -- %s with the same selection", targetName, strings.Join(args, " "))
+		}
+		opts.follow(previous)
 	}
-	infra, err := terrallel.New(manifestPath)
+	_, err := run(manifestPath, targetName, command{args: args}, opts, previous)
+	return err
+}
+
+// RetryFailed repeats the last run for only the workspaces which did not
+// succeed in it and everything depending on them.
+func RetryFailed(manifestPath string, opts Options) error {
+	previous, err := readJournal(journalPath(manifestPath))
 	if err != nil {
 		return err
 	}
+	if previous == nil {
+		return fmt.Errorf("no previous run to retry")
+	}
+	if !opts.Selection.equal(Selection{}) {
+		return fmt.Errorf("retry-failed runs the same selection as the last run and takes none of its own")
+	}
+	failed := false
+	for name := range previous.Workspaces {
+		_, ok := previous.succeeded(name)
+		failed = failed || (!ok && !previous.leftOut(name))
+	}
+	if !failed {
+		fmt.Printf("nothing to retry: every workspace in the last run of %s succeeded\n", previous.Target)
+		return nil
+	}
+	if !previous.Exec && terraform.Masked(previous.Args) {
+		again := "run it again with them"
+		if previous.Kind == "" {
+			again = "run it again with them and --resume"
+		}
+		return fmt.Errorf("cannot retry: the secret variables given to the last run of %s are not kept in the journal, %s", previous.Target, again)
+	}
+	opts.follow(previous)
+	opts.Selection = previous.Selection
+	// saved plan runs are repeated against the same plans.
+	switch previous.Kind {
+	case "plan":
+		return savePlans(manifestPath, previous.Target, previous.Args[1:], previous.PlanDir, opts, previous)
+	case "apply":
+		return applyPlans(manifestPath, previous.Target, previous.Args[1:], previous.PlanDir, opts, previous)
+	}
+	_, err = run(manifestPath, previous.Target, command{args: previous.Args, exec: previous.Exec}, opts, previous)
+	return err
+}
+
+// follow runs in the same order as a previous run being picked up again,
+// whatever order its command implies or was forced into.
+func (o *Options) follow(previous *journal) {
+	o.Reverse = previous.Reverse
+	o.Forward = !previous.Reverse
+}
+
+// Exec runs an arbitrary command, such as a linter or a script, in every
+// workspace of the target in dependency order. The command is run as given
+// without any of the arguments the manifest adds for terraform.
+func Exec(
+	manifestPath string,
+	targetName string,
+	args []string,
+	opts Options,
+) error {
+	_, err := run(manifestPath, targetName, command{args: args, exec: true}, opts, nil)
+	return err
+}
+
+// command is what a run does in each workspace of a target.
+type command struct {
+	// args are the terraform arguments the run was asked for.
+	args []string
+	// exec is set when args are an arbitrary program and its arguments to
+	// run instead of terraform.
+	exec bool
+	// kind and planDir are journaled for runs which save plans into or apply
+	// plans from a directory, so they can be retried the same way.
+	kind    string
+	planDir string
+	// workspaceArgs, when set, gives the arguments for each workspace
+	// instead of args.
+	workspaceArgs func(workspace string) []string
+	// savedPlan is set when every workspace applies a saved plan.
+	savedPlan bool
+	// plan, when set, gives the plan file each workspace saves so it can be
+	// summarised.
+	plan func(workspace string) string
+	// report, when set, is given the tree and the job of every workspace
+	// once the run is over.
+	report func(runner *terrallel.Tree, jobs map[string]workspaceJob)
+	// check, when set, is given the directory of every workspace about to be
+	// run and can refuse to start the run.
+	check func(dirs map[string]string) error
+	// readOnly runs leave the journal of the last run alone, so they never
+	// stand in the way of retrying or resuming it.
+	readOnly bool
+}
+
+// run runs a command in every workspace of the target and returns the
+// journal it recorded. When a previous run is given, workspaces which
+// succeeded in it are skipped unless they depend on one which did not.
+func run(
+	manifestPath string,
+	targetName string,
+	cmd command,
+	opts Options,
+	previous *journal,
+) (*journal, error) {
+	args := cmd.args
+	reverse, err := opts.reverse(args)
+	if cmd.exec {
+		// only terraform commands imply an order.
+		reverse, err = opts.reverse(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	opts.Reverse = reverse
+	if opts.KeepGoing && opts.FailFast {
+		return nil, fmt.Errorf("keep-going and fail-fast cannot be used together")
+	}
+	if opts.Parallelism < 0 {
+		return nil, fmt.Errorf("parallelism must not be negative")
+	}
+	if opts.Timeout < 0 || opts.JobTimeout < 0 || (opts.Grace != nil && *opts.Grace < 0) {
+		return nil, fmt.Errorf("timeouts must not be negative")
+	}
+	infra, err := terrallel.New(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Parallelism == 0 {
+		opts.Parallelism = infra.Config.Parallelism
+	}
+	if opts.Pools == nil {
+		opts.Pools = infra.Config.Pools
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = infra.Config.Timeout
+	}
+	if opts.JobTimeout == 0 {
+		opts.JobTimeout = infra.Config.JobTimeout
+	}
+	if opts.Grace == nil {
+		opts.Grace = infra.Config.Grace
+	}
+	// unless a grace period is set only jobs which timed out are killed.
+	grace, timeoutsOnly := defaultGrace, opts.Grace == nil
+	if !timeoutsOnly {
+		grace = *opts.Grace
+	}
+	// a stopped job is killed twice the grace period after it is stopped, so
+	// the run waits a little longer than that for it to go.
+	if grace > 0 {
+		opts.StopWait = 2*grace + time.Second
+	}
+	if opts.PluginCache == "" {
+		opts.PluginCache = infra.Config.PluginCache
+	}
+	if opts.PluginCache != "" {
+		if opts.PluginCache, err = pluginCache(opts.PluginCache, opts.DryRun); err != nil {
+			return nil, err
+		}
+	}
 	target, ok := infra.Manifest[targetName]
 	if !ok {
-		return fmt.Errorf("target %s not found", targetName)
+		return nil, fmt.Errorf("target %s not found", targetName)
 	}
-	runner := target.Runner(func(name string) terrallel.Job {
+	var retryErr error
+	newJob := func(ws terrallel.Workspace) *terraform.Job {
+		settings := infra.Config.Retry
+		if ws.Retry != nil {
+			settings = ws.Retry
+		}
+		timeout := opts.JobTimeout
+		if ws.Timeout != 0 {
+			timeout = ws.Timeout
+		}
+		retry, err := newRetry(settings)
+		if err != nil && retryErr == nil {
+			retryErr = fmt.Errorf("workspace %s: %w", ws.Path, err)
+		}
+		bin := ws.Binary
+		if bin == "" {
+			bin = opts.Bin
+		}
+		if bin == "" {
+			bin = infra.Config.Binary
+		}
+		jobArgs := args
+		if cmd.workspaceArgs != nil {
+			jobArgs = cmd.workspaceArgs(ws.Key())
+		}
+		backend := terraform.BackendOf(bin)
+		if cmd.exec {
+			bin, jobArgs, backend = args[0], args[1:], terraform.Command
+		} else {
+			jobArgs = workspaceArgs(ws, jobArgs, cmd.savedPlan)
+		}
+		plan := ""
+		if cmd.plan != nil {
+			plan = cmd.plan(ws.Key())
+		}
+		env := ws.Env
+		if _, ok := env[pluginCacheEnv]; !ok && opts.PluginCache != "" {
+			env = map[string]string{pluginCacheEnv: opts.PluginCache}
+			for key, value := range ws.Env {
+				env[key] = value
+			}
+		}
 		return &terraform.Job{
-			Name:    name,
-			Basedir: infra.Config.Basedir,
-			Args:    args,
-			Stdout:  os.Stdout,
-			Stderr:  os.Stderr,
+			Name:              ws.Path,
+			Workspace:         ws.TerraformWorkspace,
+			Basedir:           infra.Config.Basedir,
+			Bin:               bin,
+			Backend:           backend,
+			Args:              jobArgs,
+			Retry:             retry,
+			Timeout:           timeout,
+			Grace:             grace,
+			GraceTimeoutsOnly: timeoutsOnly,
+			Plan:              plan,
+			Env:               env,
+			AutoInit:          opts.AutoInit && !cmd.exec && !isInit(jobArgs),
+			Stdout:            os.Stdout,
+			Stderr:            os.Stderr,
 		}
+	}
+	jobs := map[string]workspaceJob{}
+	workspaces := map[string]terrallel.Workspace{}
+	runner, err := target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+		job := newJob(ws)
+		jobs[ws.Key()] = job
+		workspaces[ws.Key()] = ws
+		return job
 	})
-	err = runner.Do(reverse, dryrun)
-	if !dryrun {
-		os.Stdout.Write([]byte("\n" + runner.String()))
+	if err != nil {
+		return nil, err
 	}
-	return err
+	if retryErr != nil {
+		return nil, retryErr
+	}
+	if previous != nil {
+		rerun := rerunnable(runner, jobs, previous, opts.Reverse)
+		jobs = map[string]workspaceJob{}
+		runner, _ = target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+			name := ws.Key()
+			if rerun[name] {
+				jobs[name] = newJob(ws)
+			} else {
+				jobs[name] = &resumed{name: name, record: previous.Workspaces[name], stdout: os.Stdout}
+			}
+			return jobs[name]
+		})
+	}
+	runner, pruned, err := opts.Selection.apply(runner, jobs, workspaces, opts.Reverse)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Exclude, err = opts.Selection.exclude(jobs, workspaces); err != nil {
+		return nil, err
+	}
+	dirs := map[string]string{}
+	for name, job := range jobs {
+		if !opts.Exclude[job] {
+			dirs[name] = filepath.Join(infra.Config.Basedir, workspaces[name].Path)
+		}
+	}
+	if cmd.check != nil {
+		if err := cmd.check(dirs); err != nil {
+			return nil, err
+		}
+	}
+	// parallel inits sharing a plugin cache would race to install the same
+	// providers into it, so one workspace per lock file fills it first, one
+	// at a time. An init can simply run those before any other job, but
+	// anything else run with --auto-init keeps its order and has the inits
+	// of those workspaces done beforehand.
+	warm := opts.PluginCache != "" && !cmd.exec && (isInit(args) || opts.AutoInit)
+	if warm {
+		first, err := warmers(dirs)
+		if err != nil {
+			return nil, err
+		}
+		if isInit(args) {
+			opts.First = map[terrallel.Job]bool{}
+			for name := range first {
+				opts.First[jobs[name]] = true
+			}
+		} else if !opts.DryRun {
+			if err := warmUp(jobs, first, dirs, opts.StopWait); err != nil {
+				return nil, err
+			}
+		}
+	}
+	started := time.Now()
+	err = runner.Do(opts.Options)
+	if opts.DryRun {
+		return nil, err
+	}
+	os.Stdout.Write([]byte("\n" + runner.String()))
+	if cmd.report != nil {
+		cmd.report(runner, jobs)
+	}
+	if warm {
+		printCacheSavings(os.Stdout, opts.PluginCache, dirs)
+	}
+	// secrets given on the command line are never written down.
+	journaled := args
+	if !cmd.exec {
+		journaled = terraform.MaskArgs(args)
+	}
+	record := &journal{
+		Target:     targetName,
+		Args:       journaled,
+		Exec:       cmd.exec,
+		Kind:       cmd.kind,
+		PlanDir:    cmd.planDir,
+		Reverse:    opts.Reverse,
+		Selection:  opts.Selection,
+		Basedir:    infra.Config.Basedir,
+		Started:    started,
+		Finished:   time.Now(),
+		Workspaces: map[string]terraform.Record{},
+	}
+	for name, job := range jobs {
+		record.Workspaces[name] = job.Record()
+	}
+	for _, name := range pruned {
+		record.Workspaces[name] = terraform.Record{Status: notSelected, ExitCode: -1}
+	}
+	if !cmd.readOnly {
+		if writeErr := record.write(journalPath(manifestPath)); writeErr != nil {
+			return record, errors.Join(err, writeErr)
+		}
+	}
+	if err == nil {
+		for _, workspace := range record.Workspaces {
+			if workspace.Status == "changes" {
+				return record, ErrChanges
+			}
+		}
+	}
+	return record, err
+}
+
+// rerunnable returns the names of workspaces which did not succeed in the
+// previous run along with every workspace depending on them. Workspaces the
+// previous run left out are included so the same selection leaves them out
+// again, but what depends on them is not.
+func rerunnable(runner *terrallel.Tree, jobs map[string]workspaceJob, previous *journal, reverse bool) map[string]bool {
+	var unfinished []terrallel.Job
+	for name, job := range jobs {
+		if _, ok := previous.succeeded(name); !ok && !previous.leftOut(name) {
+			unfinished = append(unfinished, job)
+		}
+	}
+	dependents := runner.Dependents(reverse, unfinished)
+	rerun := map[string]bool{}
+	for name, job := range jobs {
+		rerun[name] = dependents[job] || previous.leftOut(name)
+	}
+	return rerun
+}
+
+func newRetry(settings *terrallel.Retry) (terraform.Retry, error) {
+	retry := terraform.Retry{}
+	if settings == nil {
+		return retry, nil
+	}
+	if settings.Attempts < 0 || settings.Backoff < 0 {
+		return retry, fmt.Errorf("retry attempts and backoff must not be negative")
+	}
+	retry.Attempts = settings.Attempts
+	retry.Backoff = settings.Backoff
+	for _, pattern := range settings.Match {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return retry, fmt.Errorf("retry match: %w", err)
+		}
+		retry.Match = append(retry.Match, re)
+	}
+	return retry, nil
 }
@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/scaleoutllc/terrallel/internal/terraform"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+func TestRerunnable(t *testing.T) {
+	tests := map[string]struct {
+		previous map[string]string
+		reverse  bool
+		expected []string
+	}{
+		"failures and what depends on them": {
+			previous: map[string]string{"a": "success", "b": "failed", "c": "success"},
+			expected: []string{"b", "c"},
+		},
+		"workspaces missing from the previous run": {
+			previous: map[string]string{"a": "success", "b": "success"},
+			expected: []string{"c"},
+		},
+		"workspaces left out by the selection": {
+			previous: map[string]string{"a": notSelected, "b": notSelected, "c": "success"},
+			expected: []string{"a", "b"},
+		},
+		"workspaces filtered out": {
+			previous: map[string]string{"a": "excluded", "b": "success", "c": "success"},
+			expected: []string{"a"},
+		},
+		"failures when reversed": {
+			previous: map[string]string{"a": "success", "b": "failed", "c": "failed"},
+			reverse:  true,
+			expected: []string{"a", "b", "c"},
+		},
+		"failures when reversed without their dependencies": {
+			previous: map[string]string{"a": "success", "b": "failed", "c": "success"},
+			reverse:  true,
+			expected: []string{"b"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			jobs := map[string]workspaceJob{}
+			for _, name := range []string{"a", "b", "c"} {
+				jobs[name] = &resumed{name: name, stdout: io.Discard}
+			}
+			runner := &terrallel.Tree{
+				Jobs: []terrallel.Job{jobs["a"], jobs["b"]},
+				Next: &terrallel.Tree{Jobs: []terrallel.Job{jobs["c"]}},
+			}
+			previous := &journal{Workspaces: map[string]terraform.Record{}}
+			for name, status := range tc.previous {
+				previous.Workspaces[name] = terraform.Record{Status: status}
+			}
+			var actual []string
+			for name, rerun := range rerunnable(runner, jobs, previous, tc.reverse) {
+				if rerun {
+					actual = append(actual, name)
+				}
+			}
+			sort.Strings(actual)
+			if diff := cmp.Diff(tc.expected, actual); diff != "" {
+				t.Errorf("rerun mismatch (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSecretArgsJournal(t *testing.T) {
+	f := newSavedPlanFixture(t)
+	f.fail(t, "apply", "b")
+	args := []string{"apply", "-var=db_password=hunter2", "-var", "region=eu"}
+	if err := Root(f.manifest, "dev", args, f.opts); err == nil {
+		t.Fatalf("expected apply to fail in b")
+	}
+	content, err := os.ReadFile(journalPath(f.manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "hunter2") {
+		t.Errorf("expected secret variables to be masked in the journal, got\n%s", content)
+	}
+	f.log(t)
+	f.fail(t, "apply")
+	if err := RetryFailed(f.manifest, Options{Bin: f.opts.Bin}); err == nil || !strings.Contains(err.Error(), "--resume") {
+		t.Errorf("expected retrying with masked secrets to be refused, got %v", err)
+	}
+	if lines := f.log(t); len(lines) != 0 {
+		t.Errorf("expected nothing to be run, got %v", lines)
+	}
+	opts := f.opts
+	opts.Resume = true
+	if err := Root(f.manifest, "dev", args, opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"b apply -var=db_password=hunter2 -var region=eu",
+		"c apply -var=db_password=hunter2 -var region=eu",
+	}
+	if diff := cmp.Diff(expected, f.log(t)); diff != "" {
+		t.Errorf("resumed apply mismatch (-expected +actual):\n%s", diff)
+	}
+}
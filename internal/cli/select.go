@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+// Selection narrows a run to part of a target. Workspaces and targets are
+// both referred to by name.
+type Selection struct {
+	// From runs only the named workspace or target and what comes after it.
+	From string `json:"from,omitempty"`
+	// To runs only the named workspace or target and what comes before it.
+	To string `json:"to,omitempty"`
+	// WithDeps runs only the named workspace and everything it is built on.
+	WithDeps string `json:"with_deps,omitempty"`
+	// WithDependents runs only the named workspace and everything built on
+	// it.
+	WithDependents string `json:"with_dependents,omitempty"`
+	// OnlyGlobs excludes every workspace whose path matches none of them.
+	OnlyGlobs []string `json:"only,omitempty"`
+	// ExcludeGlobs excludes every workspace whose path matches any of them.
+	ExcludeGlobs []string `json:"exclude,omitempty"`
+	// LabelSelectors excludes every workspace without all of these labels,
+	// each written as key=value. A label given more than once may have any
+	// of its values.
+	LabelSelectors []string `json:"select,omitempty"`
+}
+
+// notSelected is the status journaled for workspaces pruned from a run by
+// the selection.
+const notSelected = "not-selected"
+
+func (s Selection) equal(other Selection) bool {
+	return s.From == other.From &&
+		s.To == other.To &&
+		s.WithDeps == other.WithDeps &&
+		s.WithDependents == other.WithDependents &&
+		slices.Equal(s.OnlyGlobs, other.OnlyGlobs) &&
+		slices.Equal(s.ExcludeGlobs, other.ExcludeGlobs) &&
+		slices.Equal(s.LabelSelectors, other.LabelSelectors)
+}
+
+// apply prunes the tree, and the jobs by workspace, to the selection and
+// returns the names of the workspaces it pruned. Before and after follow the
+// direction the tree is being run in.
+func (s Selection) apply(runner *terrallel.Tree, jobs map[string]workspaceJob, workspaces map[string]terrallel.Workspace, reverse bool) (*terrallel.Tree, []string, error) {
+	var keep map[terrallel.Job]bool
+	if s.From != "" {
+		from, err := find(runner, jobs, workspaces, s.From)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from: %w", err)
+		}
+		keep = intersect(keep, runner.Dependents(reverse, from))
+	}
+	if s.To != "" {
+		to, err := find(runner, jobs, workspaces, s.To)
+		if err != nil {
+			return nil, nil, fmt.Errorf("to: %w", err)
+		}
+		keep = intersect(keep, runner.Dependencies(reverse, to))
+	}
+	// dependencies are about what is built on what, whichever direction
+	// the tree is being run in.
+	if s.WithDeps != "" {
+		selected, err := find(runner, jobs, workspaces, s.WithDeps)
+		if err != nil {
+			return nil, nil, fmt.Errorf("with-deps: %w", err)
+		}
+		keep = intersect(keep, runner.Dependencies(false, selected))
+	}
+	if s.WithDependents != "" {
+		selected, err := find(runner, jobs, workspaces, s.WithDependents)
+		if err != nil {
+			return nil, nil, fmt.Errorf("with-dependents: %w", err)
+		}
+		keep = intersect(keep, runner.Dependents(false, selected))
+	}
+	if keep == nil {
+		return runner, nil, nil
+	}
+	if len(keep) == 0 {
+		return nil, nil, fmt.Errorf("no workspaces match every selection")
+	}
+	var pruned []string
+	for name, job := range jobs {
+		if !keep[job] {
+			pruned = append(pruned, name)
+			delete(jobs, name)
+		}
+	}
+	sort.Strings(pruned)
+	return runner.Prune(keep), pruned, nil
+}
+
+// exclude returns the jobs of workspaces filtered out of the run. They stay in
+// the tree so they are reported and so the rest keeps its order.
+func (s Selection) exclude(jobs map[string]workspaceJob, workspaces map[string]terrallel.Workspace) (map[terrallel.Job]bool, error) {
+	only, err := compileGlobs(s.OnlyGlobs)
+	if err != nil {
+		return nil, fmt.Errorf("only: %w", err)
+	}
+	exclude, err := compileGlobs(s.ExcludeGlobs)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	selectors := map[string][]string{}
+	for _, selector := range s.LabelSelectors {
+		key, value, ok := strings.Cut(selector, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("select: %q must be written as key=value", selector)
+		}
+		selectors[key] = append(selectors[key], value)
+	}
+	excluded := map[terrallel.Job]bool{}
+	for name, job := range jobs {
+		ws := workspaces[name]
+		switch {
+		case len(only) != 0 && !matchAny(only, name) && !matchAny(only, path.Clean(ws.Path)):
+			excluded[job] = true
+		case matchAny(exclude, name) || matchAny(exclude, path.Clean(ws.Path)):
+			excluded[job] = true
+		default:
+			for key, values := range selectors {
+				if !slices.Contains(values, ws.Labels[key]) {
+					excluded[job] = true
+				}
+			}
+		}
+	}
+	return excluded, nil
+}
+
+// compileGlobs turns workspace path globs into regular expressions. A single
+// * or ? never matches a path separator while ** matches any number of path
+// segments.
+func compileGlobs(globs []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, glob := range globs {
+		var expr strings.Builder
+		expr.WriteString("^")
+		for i := 0; i < len(glob); i++ {
+			switch c := glob[i]; {
+			case strings.HasPrefix(glob[i:], "**/"):
+				expr.WriteString("(.*/)?")
+				i += 2
+			case strings.HasPrefix(glob[i:], "**"):
+				expr.WriteString(".*")
+				i++
+			case c == '*':
+				expr.WriteString("[^/]*")
+			case c == '?':
+				expr.WriteString("[^/]")
+			default:
+				expr.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		expr.WriteString("$")
+		re, err := regexp.Compile(expr.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func matchAny(globs []*regexp.Regexp, name string) bool {
+	for _, glob := range globs {
+		if glob.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the job of the named workspace or every job of the named
+// target. A path run under several terraform workspaces names all of them.
+func find(runner *terrallel.Tree, jobs map[string]workspaceJob, workspaces map[string]terrallel.Workspace, name string) ([]terrallel.Job, error) {
+	if job, ok := jobs[path.Clean(name)]; ok {
+		return []terrallel.Job{job}, nil
+	}
+	var found []terrallel.Job
+	for key, job := range jobs {
+		if path.Clean(workspaces[key].Path) == path.Clean(name) {
+			found = append(found, job)
+		}
+	}
+	if len(found) != 0 {
+		return found, nil
+	}
+	if found = runner.Find(name); len(found) != 0 {
+		return found, nil
+	}
+	return nil, fmt.Errorf("no workspace or target named %s", name)
+}
+
+// intersect narrows a selection to the jobs also in other. A nil selection
+// has not been narrowed yet and holds everything.
+func intersect(selected map[terrallel.Job]bool, other map[terrallel.Job]bool) map[terrallel.Job]bool {
+	if selected == nil {
+		return other
+	}
+	both := map[terrallel.Job]bool{}
+	for job := range selected {
+		if other[job] {
+			both[job] = true
+		}
+	}
+	return both
+}
@@ -0,0 +1,222 @@
+package cli
+
+import (
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+func TestCompileGlobs(t *testing.T) {
+	tests := map[string]struct {
+		glob     string
+		matches  []string
+		rejected []string
+	}{
+		"literal path": {
+			glob:     "dev/aws/global",
+			matches:  []string{"dev/aws/global"},
+			rejected: []string{"dev/aws/global/extra", "dev/aws", "dev/awsxglobal"},
+		},
+		"star stays within a directory": {
+			glob:     "dev/*/global",
+			matches:  []string{"dev/aws/global", "dev/gcp/global"},
+			rejected: []string{"dev/aws/us-east-1/global", "dev/global"},
+		},
+		"question mark is one character": {
+			glob:     "dev/aw?/global",
+			matches:  []string{"dev/aws/global"},
+			rejected: []string{"dev/aw/global", "dev/aw/x/global"},
+		},
+		"double star crosses directories": {
+			glob:     "dev/aws/**",
+			matches:  []string{"dev/aws/global", "dev/aws/us-east-1/cluster/k8s"},
+			rejected: []string{"dev/gcp/global"},
+		},
+		"leading double star matches no directories too": {
+			glob:     "**/services",
+			matches:  []string{"services", "dev/aws/us-east-1/cluster/services"},
+			rejected: []string{"dev/services/k8s", "dev/myservices"},
+		},
+		"regular expression characters are literal": {
+			glob:     "dev/a+b.c",
+			matches:  []string{"dev/a+b.c"},
+			rejected: []string{"dev/aab.c", "dev/a+bxc"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			compiled, err := compileGlobs([]string{tc.glob})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range tc.matches {
+				if !matchAny(compiled, path) {
+					t.Errorf("expected %s to match %s", tc.glob, path)
+				}
+			}
+			for _, path := range tc.rejected {
+				if matchAny(compiled, path) {
+					t.Errorf("expected %s not to match %s", tc.glob, path)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectionExclude(t *testing.T) {
+	workspaces := map[string]terrallel.Workspace{
+		"aws/network":  {Path: "aws/network", Labels: map[string]string{"provider": "aws", "tier": "network"}},
+		"gcp/network":  {Path: "gcp/network", Labels: map[string]string{"provider": "gcp", "tier": "network"}},
+		"azure/global": {Path: "azure/global", Labels: map[string]string{"provider": "azure"}},
+		"shared/dns":   {Path: "shared/dns"},
+	}
+	tests := map[string]struct {
+		selection   Selection
+		expected    []string
+		expectedErr string
+	}{
+		"nothing filtered": {},
+		"only": {
+			selection: Selection{OnlyGlobs: []string{"*/network"}},
+			expected:  []string{"azure/global", "shared/dns"},
+		},
+		"exclude": {
+			selection: Selection{ExcludeGlobs: []string{"shared/**", "azure/*"}},
+			expected:  []string{"azure/global", "shared/dns"},
+		},
+		"select": {
+			selection: Selection{LabelSelectors: []string{"provider=aws"}},
+			expected:  []string{"azure/global", "gcp/network", "shared/dns"},
+		},
+		"select a label more than once": {
+			selection: Selection{LabelSelectors: []string{"provider=aws", "provider=gcp"}},
+			expected:  []string{"azure/global", "shared/dns"},
+		},
+		"select several labels": {
+			selection: Selection{LabelSelectors: []string{"provider=aws", "provider=gcp", "tier=network"}},
+			expected:  []string{"azure/global", "shared/dns"},
+		},
+		"select an empty label": {
+			selection: Selection{LabelSelectors: []string{"provider="}},
+			expected:  []string{"aws/network", "azure/global", "gcp/network"},
+		},
+		"select without a value": {
+			selection:   Selection{LabelSelectors: []string{"provider"}},
+			expectedErr: `select: "provider" must be written as key=value`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			jobs := map[string]workspaceJob{}
+			names := map[terrallel.Job]string{}
+			for name := range workspaces {
+				jobs[name] = &resumed{name: name, stdout: io.Discard}
+				names[jobs[name]] = name
+			}
+			excluded, err := tc.selection.exclude(jobs, workspaces)
+			actualErr := ""
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if actualErr != tc.expectedErr {
+				t.Fatalf("expected error %q, got %q", tc.expectedErr, actualErr)
+			}
+			var actual []string
+			for job := range excluded {
+				actual = append(actual, names[job])
+			}
+			sort.Strings(actual)
+			if diff := cmp.Diff(tc.expected, actual); diff != "" {
+				t.Errorf("excluded mismatch (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSelectionApply(t *testing.T) {
+	tests := map[string]struct {
+		selection      Selection
+		reverse        bool
+		expectedKept   []string
+		expectedPruned []string
+	}{
+		"from": {
+			selection:      Selection{From: "a"},
+			expectedKept:   []string{"a", "c"},
+			expectedPruned: []string{"b"},
+		},
+		"from when reversed": {
+			selection:      Selection{From: "a"},
+			reverse:        true,
+			expectedKept:   []string{"a"},
+			expectedPruned: []string{"b", "c"},
+		},
+		"to when reversed": {
+			selection:      Selection{To: "a"},
+			reverse:        true,
+			expectedKept:   []string{"a", "c"},
+			expectedPruned: []string{"b"},
+		},
+		"with deps": {
+			selection:      Selection{WithDeps: "c"},
+			expectedKept:   []string{"a", "b", "c"},
+			expectedPruned: nil,
+		},
+		"with deps when reversed": {
+			selection:      Selection{WithDeps: "a"},
+			reverse:        true,
+			expectedKept:   []string{"a"},
+			expectedPruned: []string{"b", "c"},
+		},
+		"with dependents": {
+			selection:      Selection{WithDependents: "a"},
+			expectedKept:   []string{"a", "c"},
+			expectedPruned: []string{"b"},
+		},
+		"with dependents when reversed": {
+			selection:      Selection{WithDependents: "a"},
+			reverse:        true,
+			expectedKept:   []string{"a", "c"},
+			expectedPruned: []string{"b"},
+		},
+		"with dependents of a target when reversed": {
+			selection:      Selection{WithDependents: "next"},
+			reverse:        true,
+			expectedKept:   []string{"c"},
+			expectedPruned: []string{"a", "b"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			jobs := map[string]workspaceJob{}
+			workspaces := map[string]terrallel.Workspace{}
+			for _, name := range []string{"a", "b", "c"} {
+				jobs[name] = &resumed{name: name, stdout: io.Discard}
+				workspaces[name] = terrallel.Workspace{Path: name}
+			}
+			runner := &terrallel.Tree{
+				Name: "dev",
+				Jobs: []terrallel.Job{jobs["a"], jobs["b"]},
+				Next: &terrallel.Tree{Name: "next", Jobs: []terrallel.Job{jobs["c"]}},
+			}
+			_, pruned, err := tc.selection.apply(runner, jobs, workspaces, tc.reverse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for name := range jobs {
+				kept = append(kept, name)
+			}
+			sort.Strings(kept)
+			if diff := cmp.Diff(tc.expectedKept, kept); diff != "" {
+				t.Errorf("kept mismatch (-expected +actual):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.expectedPruned, pruned); diff != "" {
+				t.Errorf("pruned mismatch (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
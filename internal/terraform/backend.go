@@ -0,0 +1,56 @@
+package terraform
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Backend is the kind of program a job runs, which decides which of
+// terraform's conventions terrallel relies on it to follow.
+type Backend string
+
+const (
+	// Terraform is terraform itself or any program sharing its command line
+	// and working directory layout. It is what a job without a backend runs.
+	Terraform Backend = "terraform"
+	// OpenTofu behaves exactly like terraform.
+	OpenTofu Backend = "tofu"
+	// Terragrunt passes commands and their exit codes through to terraform,
+	// but initialises workspaces by itself, often in a cache directory of its
+	// own rather than in the workspace.
+	Terragrunt Backend = "terragrunt"
+	// Command is any other program, run as given.
+	Command Backend = "command"
+)
+
+// BackendOf tells the backend of a terraform-compatible program from its
+// name. Programs which are neither tofu nor terragrunt are taken to behave
+// like terraform.
+func BackendOf(bin string) Backend {
+	switch strings.TrimSuffix(filepath.Base(bin), ".exe") {
+	case "tofu":
+		return OpenTofu
+	case "terragrunt":
+		return Terragrunt
+	}
+	return Terraform
+}
+
+// ManagesInit reports whether the backend has to be left to initialise
+// workspaces by itself, as what it installs is not in the workspace's
+// .terraform directory or it isn't terraform at all.
+func (b Backend) ManagesInit() bool {
+	return b == Terragrunt || b == Command
+}
+
+// detailedExitCodes reports whether the backend exits with 2 for changes
+// when given -detailed-exitcode.
+func (b Backend) detailedExitCodes() bool {
+	return b != Command
+}
+
+// createsWorkspaces reports whether terraform workspaces can be created in
+// the workspace directory before running the command.
+func (b Backend) createsWorkspaces() bool {
+	return b != Terragrunt && b != Command
+}
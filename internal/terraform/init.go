@@ -0,0 +1,158 @@
+package terraform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// InitArgs are the arguments a workspace is initialised with before running
+// when AutoInit is set.
+var InitArgs = []string{"init", "-input=false"}
+
+var lockSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "provider", LabelNames: []string{"source"}},
+	},
+}
+
+var lockProviderSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "version"},
+	},
+}
+
+var moduleSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "module", LabelNames: []string{"name"}},
+	},
+}
+
+// NeedsInit reports why the workspace in dir has to be initialised before
+// anything else will run there, or "" when it is ready. A workspace needs
+// init when it never has been, when a provider in its lock file is not the
+// version installed or when it calls a module which is not installed.
+// Configuration which can't be read is left for terraform to complain about.
+func NeedsInit(dir string) (string, error) {
+	dotTerraform := filepath.Join(dir, ".terraform")
+	if _, err := os.Stat(dotTerraform); errors.Is(err, fs.ErrNotExist) {
+		return "not initialised", nil
+	} else if err != nil {
+		return "", err
+	}
+	providers, err := lockedProviders(filepath.Join(dir, ".terraform.lock.hcl"))
+	if err != nil {
+		return "", err
+	}
+	for source, version := range providers {
+		installed := filepath.Join(dotTerraform, "providers", filepath.FromSlash(source), version)
+		if _, err := os.Stat(installed); err != nil {
+			return fmt.Sprintf("%s %s not installed", source, version), nil
+		}
+	}
+	modules, err := installedModules(filepath.Join(dotTerraform, "modules", "modules.json"))
+	if err != nil {
+		return "", err
+	}
+	calls, err := moduleCalls(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range calls {
+		if !modules[name] {
+			return fmt.Sprintf("module %s not installed", name), nil
+		}
+	}
+	return "", nil
+}
+
+// lockedProviders returns the version of every provider in a lock file,
+// keyed by its source address.
+func lockedProviders(path string) (map[string]string, error) {
+	src, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, diags := hclsyntax.ParseConfig(src, path, hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, nil
+	}
+	content, _, _ := file.Body.PartialContent(lockSchema)
+	providers := map[string]string{}
+	for _, block := range content.Blocks {
+		attrs, _, _ := block.Body.PartialContent(lockProviderSchema)
+		attr, ok := attrs.Attributes["version"]
+		if !ok {
+			continue
+		}
+		value, diags := attr.Expr.Value(nil)
+		if !diags.HasErrors() && value.Type() == cty.String && value.IsKnown() && !value.IsNull() {
+			providers[block.Labels[0]] = value.AsString()
+		}
+	}
+	return providers, nil
+}
+
+// installedModules returns the keys of the modules recorded by init.
+func installedModules(path string) (map[string]bool, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Modules []struct {
+			Key string `json:"Key"`
+		} `json:"Modules"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return map[string]bool{}, nil
+	}
+	modules := map[string]bool{}
+	for _, module := range manifest.Modules {
+		modules[module.Key] = true
+	}
+	return modules, nil
+}
+
+// moduleCalls returns the names of the modules called by the configuration
+// in dir.
+func moduleCalls(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tf") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file, diags := hclsyntax.ParseConfig(src, path, hcl.Pos{Line: 1, Column: 1})
+		if diags.HasErrors() {
+			continue
+		}
+		content, _, _ := file.Body.PartialContent(moduleSchema)
+		for _, block := range content.Blocks {
+			names = append(names, block.Labels[0])
+		}
+	}
+	return names, nil
+}
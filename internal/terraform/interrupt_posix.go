@@ -18,3 +18,20 @@ func interrupt(cmd *exec.Cmd) error {
 	}
 	return cmd.Process.Signal(syscall.SIGINT)
 }
+
+// terminate sends SIGTERM to the process group of the command.
+func terminate(cmd *exec.Cmd) error {
+	return signalGroup(cmd, unix.SIGTERM)
+}
+
+// kill sends SIGKILL to the process group of the command.
+func kill(cmd *exec.Cmd) error {
+	return signalGroup(cmd, unix.SIGKILL)
+}
+
+func signalGroup(cmd *exec.Cmd, sig unix.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return unix.Kill(-cmd.Process.Pid, sig)
+}
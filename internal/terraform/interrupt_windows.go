@@ -54,3 +54,16 @@ func interrupt(cmd *exec.Cmd) error {
 	}
 	return nil
 }
+
+// terminate stops the process. Windows has no equivalent of SIGTERM so this
+// is the same as kill.
+func terminate(cmd *exec.Cmd) error {
+	return kill(cmd)
+}
+
+func kill(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
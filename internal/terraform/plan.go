@@ -0,0 +1,78 @@
+package terraform
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// PlanSummary counts the changes in a saved plan. Replaced resources count
+// as both added and destroyed, the same as terraform reports them.
+type PlanSummary struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+	// Destroyed lists the addresses of resources the plan destroys.
+	Destroyed []string `json:"destroyed,omitempty"`
+	// Drifted lists the addresses of resources which changed outside of
+	// terraform since they were last applied.
+	Drifted []string `json:"drifted,omitempty"`
+}
+
+func (p *PlanSummary) String() string {
+	var parts []string
+	if p.Add+p.Change+p.Destroy != 0 || len(p.Drifted) == 0 {
+		parts = append(parts, fmt.Sprintf("%d to add, %d to change, %d to destroy", p.Add, p.Change, p.Destroy))
+	}
+	if len(p.Drifted) != 0 {
+		parts = append(parts, fmt.Sprintf("%d drifted", len(p.Drifted)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summarisePlan reads the plan file with terraform show.
+func (j *Job) summarisePlan(dir string) (*PlanSummary, error) {
+	cmd := j.command(dir, []string{"show", "-json", j.Plan})
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("show: %w", err)
+	}
+	return parsePlan(out)
+}
+
+func parsePlan(content []byte) (*PlanSummary, error) {
+	type resourceChange struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	}
+	var plan struct {
+		ResourceChanges []resourceChange `json:"resource_changes"`
+		ResourceDrift   []resourceChange `json:"resource_drift"`
+	}
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return nil, fmt.Errorf("parsing plan: %w", err)
+	}
+	summary := &PlanSummary{}
+	for _, rc := range plan.ResourceChanges {
+		actions := rc.Change.Actions
+		if slices.Contains(actions, "create") {
+			summary.Add++
+		}
+		if slices.Contains(actions, "update") {
+			summary.Change++
+		}
+		if slices.Contains(actions, "delete") {
+			summary.Destroy++
+			summary.Destroyed = append(summary.Destroyed, rc.Address)
+		}
+	}
+	for _, rc := range plan.ResourceDrift {
+		if !slices.Equal(rc.Change.Actions, []string{"no-op"}) {
+			summary.Drifted = append(summary.Drifted, rc.Address)
+		}
+	}
+	return summary, nil
+}
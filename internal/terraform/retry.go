@@ -0,0 +1,34 @@
+package terraform
+
+import (
+	"regexp"
+	"time"
+)
+
+// Retry configures re-running a job which fails.
+type Retry struct {
+	// Attempts is the number of times to re-run after the first failure.
+	Attempts int
+	// Backoff is how long to wait before the first retry. It doubles for
+	// every attempt after that.
+	Backoff time.Duration
+	// Match limits retries to failures whose stderr matches one of these.
+	// Every failure is retried when it is empty.
+	Match []*regexp.Regexp
+}
+
+func (r Retry) matches(stderr string) bool {
+	if len(r.Match) == 0 {
+		return true
+	}
+	for _, re := range r.Match {
+		if re.MatchString(stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Retry) delay(attempt int) time.Duration {
+	return r.Backoff * time.Duration(1<<(attempt-1))
+}
@@ -3,69 +3,566 @@ package terraform
 import (
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fatih/color"
 )
 
+// secretName matches the names of environment and terraform variables whose
+// values should not be shown.
+var secretName = regexp.MustCompile(`(?i)(secret|token|password|passwd|credential|private|key)`)
+
+// maskedValue stands in for the value of anything which looks secret.
+const maskedValue = "***"
+
+// workspaceEnv selects the terraform workspace to run in.
+const workspaceEnv = "TF_WORKSPACE"
+
+// dirLocks hold a mutex for every directory jobs have initialised or selected
+// a workspace in. Jobs for several terraform workspaces of one directory
+// would otherwise race on its .terraform directory and lock file.
+var dirLocks sync.Map
+
+// lockDir waits for any other job initialising or selecting a workspace in
+// dir and returns what releases it again.
+func lockDir(dir string) func() {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	lock, _ := dirLocks.LoadOrStore(dir, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
 type Job struct {
 	Name    string
 	Basedir string
-	Bin     string
+	// Bin is the program to run, terraform unless set. OpenTofu and
+	// Terragrunt share its command line and may be used in its place.
+	Bin string
+	// Backend is the kind of program Bin is, terraform unless set. Only
+	// backends following terraform's conventions get auto-init, workspace
+	// creation and -detailed-exitcode handling.
+	Backend Backend
 	Args    []string
-	Stdout  io.Writer
-	Stderr  io.Writer
-	cmd     *exec.Cmd
-	result  string
+	Retry   Retry
+	// Timeout stops the job when it runs longer than this, retries included.
+	Timeout time.Duration
+	// Grace is how long a stopped job has to exit after SIGINT before it is
+	// sent SIGTERM and, after the same time again, SIGKILL. Zero waits for
+	// the job to exit by itself.
+	Grace time.Duration
+	// GraceTimeoutsOnly limits Grace to jobs stopped because they timed
+	// out. Jobs interrupted or stopped by a failure elsewhere are left to
+	// shut down by themselves, as killing terraform mid-apply leaves its
+	// state locked and incomplete.
+	GraceTimeoutsOnly bool
+	// Plan is the plan file the job writes. When set, the plan is summarised
+	// with terraform show once the job succeeds.
+	Plan string
+	// Env is added to the environment the command inherits.
+	Env map[string]string
+	// Workspace is the terraform workspace to run in. It is selected with
+	// TF_WORKSPACE so jobs sharing a directory never change each other's
+	// selection and, unless the command is init or workspace or the backend
+	// doesn't keep its workspaces in the directory, it is created first when
+	// it doesn't exist yet.
+	Workspace string
+	// AutoInit runs terraform init first when the workspace has never been
+	// initialised or what it has installed no longer matches its lock file
+	// and modules. It is ignored for backends which manage init themselves.
+	AutoInit bool
+	Stdout   io.Writer
+	Stderr   io.Writer
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	result   string
+	status   string
+	exitCode int
+	started  time.Time
+	finished time.Time
+	attempts []string
+	plan     *PlanSummary
+	// initStatus is the outcome of the init run because of AutoInit.
+	initStatus string
+	stopped    bool
+	timedOut   bool
+	halt       chan struct{}
+	mu         sync.Mutex
 }
 
 func (j *Job) Run(dryrun bool) error {
 	if j.Bin == "" {
 		j.Bin = "terraform"
 	}
-	prefix := fmt.Sprintf("[%s]: ", j.Name)
-	stdout := prefixWriter(j.Stdout, prefix)
-	stderr := prefixWriter(j.Stderr, prefix)
-	cmd := exec.Command(j.Bin, j.Args...)
+	dir := ""
 	if j.Basedir != "" {
-		cmd.Dir = filepath.Join(j.Basedir, j.Name)
+		dir = filepath.Join(j.Basedir, j.Name)
+	}
+	runInfo := fmt.Sprintf("%s %s (in %s)", j.Bin, strings.Join(j.maskedArgs(), " "), dir)
+	if dryrun {
+		env := ""
+		if masked := j.maskedEnv(); len(masked) != 0 {
+			env = strings.Join(masked, " ") + " "
+		}
+		if j.autoInit() {
+			if reason, _ := NeedsInit(dir); reason != "" {
+				fmt.Fprintf(j.Stdout, "%s%s %s (in %s, %s)\n", env, j.Bin, strings.Join(InitArgs, " "), dir, reason)
+			}
+		}
+		if j.selectsWorkspace() {
+			fmt.Fprintf(j.Stdout, "%s %s (in %s)\n", j.Bin, strings.Join(j.selectArgs(), " "), dir)
+		}
+		j.Stdout.Write([]byte(fmt.Sprintf("%s%s\n", env, runInfo)))
+		return nil
+	}
+	j.mu.Lock()
+	if j.halt == nil {
+		j.halt = make(chan struct{})
+	}
+	j.exitCode = -1
+	j.started = time.Now()
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		j.finished = time.Now()
+		j.mu.Unlock()
+	}()
+	if j.Timeout > 0 {
+		timer := time.AfterFunc(j.Timeout, j.timeout)
+		defer timer.Stop()
+	}
+	if j.autoInit() {
+		if err := j.init(dir); err != nil {
+			if j.hasTimedOut() {
+				return fmt.Errorf("timed-out: %s: exceeded %s", runInfo, j.Timeout)
+			}
+			return err
+		}
+	}
+	if j.selectsWorkspace() {
+		if err := j.selectWorkspace(dir); err != nil {
+			if j.hasTimedOut() {
+				return fmt.Errorf("timed-out: %s: exceeded %s", runInfo, j.Timeout)
+			}
+			return err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		unlock := func() {}
+		if j.changesDir() {
+			unlock = lockDir(dir)
+		}
+		stderr, started, err := j.attempt(dir, j.Args, runInfo)
+		unlock()
+		if err != nil && j.hasTimedOut() {
+			return fmt.Errorf("timed-out: %s: exceeded %s", runInfo, j.Timeout)
+		}
+		if err == nil && j.Plan != "" {
+			plan, err := j.summarisePlan(dir)
+			if err != nil {
+				fmt.Fprintf(j.Stderr, "[%s]: could not summarise plan: %s\n", j.label(), err)
+			}
+			j.mu.Lock()
+			j.plan = plan
+			j.mu.Unlock()
+			return nil
+		}
+		if err == nil || !started || j.isStopped() || attempt > j.Retry.Attempts || !j.Retry.matches(stderr) {
+			return err
+		}
+		j.mu.Lock()
+		result := j.result
+		j.attempts = append(j.attempts, result)
+		j.mu.Unlock()
+		delay := j.Retry.delay(attempt)
+		fmt.Fprintf(j.Stdout, "[%s]: %s, retrying in %s (attempt %d of %d)\n",
+			j.label(), result, delay, attempt+1, j.Retry.Attempts+1)
+		select {
+		case <-time.After(delay):
+		case <-j.halt:
+			return err
+		}
+	}
+}
+
+func (j *Job) autoInit() bool {
+	return j.AutoInit && !j.Backend.ManagesInit()
+}
+
+// init runs terraform init in the workspace when it needs it, recording the
+// outcome separately from the command the job was asked to run.
+func (j *Job) init(dir string) error {
+	// another job may be initialising the same directory, after which this
+	// one no longer needs to.
+	unlock := lockDir(dir)
+	defer unlock()
+	reason, err := NeedsInit(dir)
+	if err != nil {
+		fmt.Fprintf(j.Stderr, "[%s]: could not check whether init is needed: %s\n", j.label(), err)
+		return nil
+	}
+	if reason == "" {
+		return nil
+	}
+	fmt.Fprintf(j.Stdout, "[%s]: %s, running init first\n", j.label(), reason)
+	runInfo := fmt.Sprintf("%s %s (in %s)", j.Bin, strings.Join(InitArgs, " "), dir)
+	_, _, err = j.attempt(dir, InitArgs, runInfo)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err != nil {
+		j.initStatus = "failed"
+		if !j.stopped {
+			j.setStatus("init-failed", color.RedString)
+		}
+		return err
+	}
+	j.initStatus = "success"
+	return nil
+}
+
+// selectsWorkspace reports whether the terraform workspace has to be created
+// before the command runs.
+func (j *Job) selectsWorkspace() bool {
+	if j.Workspace == "" || !j.Backend.createsWorkspaces() {
+		return false
+	}
+	subcommand := j.subcommand()
+	return subcommand != "" && subcommand != "init" && subcommand != "workspace"
+}
+
+// changesDir reports whether the command changes what is installed in or
+// selected for the directory, so it can't run alongside another doing so.
+func (j *Job) changesDir() bool {
+	subcommand := j.subcommand()
+	return j.Backend != Command && (subcommand == "init" || subcommand == "workspace")
+}
+
+// subcommand is the terraform subcommand the job runs, or "" when there is
+// none.
+func (j *Job) subcommand() string {
+	for _, arg := range j.Args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
+
+func (j *Job) selectArgs() []string {
+	return []string{"workspace", "select", "-or-create", j.Workspace}
+}
+
+// selectWorkspace creates the terraform workspace if it doesn't exist yet.
+// terraform refuses to select a workspace while TF_WORKSPACE is set, so it
+// is cleared for this one command.
+func (j *Job) selectWorkspace(dir string) error {
+	unlock := lockDir(dir)
+	defer unlock()
+	runInfo := fmt.Sprintf("%s %s (in %s)", j.Bin, strings.Join(j.selectArgs(), " "), dir)
+	_, _, err := j.attempt(dir, j.selectArgs(), runInfo, workspaceEnv+"=")
+	if err != nil {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if !j.stopped {
+			j.setStatus("workspace-failed", color.RedString)
+		}
+	}
+	return err
+}
+
+// command prepares bin to run with args in dir. env is added after the
+// environment of the job, overriding it.
+func (j *Job) command(dir string, args []string, env ...string) *exec.Cmd {
+	cmd := exec.Command(j.Bin, args...)
+	cmd.Dir = dir
+	if env = append(j.environ(), env...); len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 	cmd.SysProcAttr = procAttrs
+	return cmd
+}
+
+// attempt runs the command once with args, returning what it wrote to stderr
+// and whether it started at all.
+func (j *Job) attempt(dir string, args []string, runInfo string, env ...string) (string, bool, error) {
+	prefix := fmt.Sprintf("[%s]: ", j.label())
+	stdout := prefixWriter(j.Stdout, prefix)
+	stderr := prefixWriter(j.Stderr, prefix)
+	cmd := j.command(dir, args, env...)
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
+	j.mu.Lock()
+	if j.stopped {
+		j.mu.Unlock()
+		return "", false, fmt.Errorf("run: %s: %s", runInfo, j.result)
+	}
 	j.cmd = cmd
-	runInfo := fmt.Sprintf("%s %s (in %s)", j.Bin, strings.Join(j.Args, " "), cmd.Dir)
-	if dryrun {
-		j.Stdout.Write([]byte(fmt.Sprintf("%s\n", runInfo)))
-		return nil
+	j.exited = make(chan struct{})
+	err := cmd.Start()
+	if err != nil {
+		j.setStatus("failed-to-start", color.RedString)
+		j.mu.Unlock()
+		return "", false, fmt.Errorf("failed-to-start: %s: %w", runInfo, err)
 	}
-	if err := j.cmd.Start(); err != nil {
-		j.result = color.RedString("failed-to-start")
-		return fmt.Errorf("failed-to-start: %s: %w", runInfo, err)
+	j.mu.Unlock()
+	err = cmd.Wait()
+	// with -detailed-exitcode terraform exits with 2 when there are changes.
+	detailed := j.Backend.detailedExitCodes() && slices.Contains(args, "-detailed-exitcode")
+	changes := detailed && err != nil && cmd.ProcessState.ExitCode() == 2
+	if changes {
+		err = nil
 	}
-	if err := j.cmd.Wait(); err != nil {
-		if j.result != color.YellowString("interrupted") {
-			j.result = color.RedString("failed")
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.exitCode = cmd.ProcessState.ExitCode()
+	close(j.exited)
+	j.cmd = nil
+	if err != nil {
+		if !j.stopped {
+			j.setStatus("failed", color.RedString)
 		}
-		return fmt.Errorf("run: %s: %w", runInfo, err)
+		return stderr.Output(), true, fmt.Errorf("run: %s: %w", runInfo, err)
 	}
-	j.result = color.GreenString("success")
-	return nil
+	switch {
+	case changes:
+		j.setStatus("changes", color.YellowString)
+	case detailed:
+		j.setStatus("no-changes", color.GreenString)
+	default:
+		j.setStatus("success", color.GreenString)
+	}
+	return stderr.Output(), true, nil
+}
+
+// environ returns Env as sorted KEY=value pairs along with the terraform
+// workspace to select.
+func (j *Job) environ() []string {
+	var env []string
+	for key, value := range j.Env {
+		if key != workspaceEnv || j.Workspace == "" {
+			env = append(env, key+"="+value)
+		}
+	}
+	if j.Workspace != "" {
+		env = append(env, workspaceEnv+"="+j.Workspace)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// label is how the job is named in its output and in the report.
+func (j *Job) label() string {
+	if j.Workspace == "" {
+		return j.Name
+	}
+	return j.Name + "@" + j.Workspace
+}
+
+// maskedEnv is environ with the values of anything which looks like a
+// secret hidden so it can be shown.
+func (j *Job) maskedEnv() []string {
+	env := j.environ()
+	for i, pair := range env {
+		key, _, _ := strings.Cut(pair, "=")
+		if secretName.MatchString(key) {
+			env[i] = key + "=" + maskedValue
+		}
+	}
+	return env
+}
+
+// maskedArgs returns the arguments with the values of -var flags whose names
+// look secret hidden, for showing in output and keeping in the journal.
+func (j *Job) maskedArgs() []string {
+	if j.Backend == Command {
+		return append([]string{}, j.Args...)
+	}
+	return MaskArgs(j.Args)
+}
+
+// MaskArgs returns terraform arguments with the values of -var flags whose
+// names look secret replaced by ***.
+func MaskArgs(args []string) []string {
+	args = append([]string{}, args...)
+	for i, arg := range args {
+		prefix := "-var="
+		variable, ok := strings.CutPrefix(arg, prefix)
+		if !ok && i > 0 && args[i-1] == "-var" {
+			prefix, variable, ok = "", arg, true
+		}
+		if !ok {
+			continue
+		}
+		if key, _, found := strings.Cut(variable, "="); found && secretName.MatchString(key) {
+			args[i] = prefix + key + "=" + maskedValue
+		}
+	}
+	return args
+}
+
+// Masked reports whether any argument had its value hidden by MaskArgs.
+func Masked(args []string) bool {
+	for _, arg := range args {
+		if strings.HasSuffix(arg, "="+maskedValue) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Job) Queued(reason string) {
+	fmt.Fprintf(j.Stdout, "[%s]: %s (%s)\n", j.label(), color.CyanString("waiting"), reason)
+}
+
+func (j *Job) Skip(reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.setStatus(fmt.Sprintf("skipped (%s)", reason), color.YellowString)
+}
+
+func (j *Job) Exclude() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.setStatus("excluded", color.YellowString)
 }
 
 func (j *Job) Cancel() error {
+	return j.stop("interrupted", color.YellowString)
+}
+
+// Abort interrupts the job like Cancel but records why it was stopped. A run
+// which has gone on too long is reported as timed out.
+func (j *Job) Abort(reason string) error {
+	if reason == "timed-out" {
+		return j.stop(reason, color.RedString)
+	}
+	return j.stop(reason, color.YellowString)
+}
+
+func (j *Job) timeout() {
+	j.mu.Lock()
+	j.timedOut = !j.stopped
+	j.mu.Unlock()
+	j.stop("timed-out", color.RedString)
+}
+
+func (j *Job) stop(status string, paint func(string, ...interface{}) string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// a job which never started has nothing to stop.
+	if j.halt == nil || j.stopped {
+		return nil
+	}
+	j.stopped = true
+	j.setStatus(status, paint)
+	close(j.halt)
 	if j.cmd != nil && j.cmd.Process != nil {
-		j.result = color.YellowString("interrupted")
+		if j.Grace > 0 && (status == "timed-out" || !j.GraceTimeoutsOnly) {
+			go j.escalate(j.cmd, j.exited)
+		}
 		return interrupt(j.cmd)
 	}
 	return nil
 }
 
+// escalate sends progressively harsher signals to a command which has not
+// exited within the grace period after being interrupted.
+func (j *Job) escalate(cmd *exec.Cmd, exited chan struct{}) {
+	for _, signal := range []func(*exec.Cmd) error{terminate, kill} {
+		select {
+		case <-exited:
+			return
+		case <-time.After(j.Grace):
+			signal(cmd)
+		}
+	}
+}
+
+func (j *Job) isStopped() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stopped
+}
+
+func (j *Job) hasTimedOut() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.timedOut
+}
+
+// setStatus records the outcome of the job along with how it is painted in
+// the report. The caller holds mu.
+func (j *Job) setStatus(status string, paint func(string, ...interface{}) string) {
+	j.status = status
+	j.result = paint("%s", status)
+}
+
 func (j *Job) Result() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	if j.result == "" {
-		j.result = color.CyanString("never-ran")
+		j.setStatus("never-ran", color.CyanString)
+	}
+	result := j.result
+	if j.initStatus == "success" {
+		result = fmt.Sprintf("%s (after init)", result)
+	}
+	if j.plan != nil {
+		result = fmt.Sprintf("%s (%s)", result, j.plan)
+	}
+	if len(j.attempts) != 0 {
+		return fmt.Sprintf("%s: %s (previous attempts: %s)", j.label(), result, strings.Join(j.attempts, ", "))
+	}
+	return fmt.Sprintf("%s: %s", j.label(), result)
+}
+
+// Record is the outcome of a job as kept between runs.
+type Record struct {
+	Status   string    `json:"status"`
+	ExitCode int       `json:"exit_code"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Args     []string  `json:"args"`
+	// Plan summarises the plan the job saved, if it saved one.
+	Plan *PlanSummary `json:"plan,omitempty"`
+	// Init is the outcome of the init run first, if one was.
+	Init string `json:"init,omitempty"`
+}
+
+// Succeeded reports whether the job ran to completion without failing.
+func (r Record) Succeeded() bool {
+	return r.Status == "success" || r.Status == "changes" || r.Status == "no-changes"
+}
+
+// Record describes the outcome of the job. The exit code is -1 when the
+// command never exited by itself.
+func (j *Job) Record() Record {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	record := Record{
+		Status:   j.status,
+		ExitCode: j.exitCode,
+		Started:  j.started,
+		Finished: j.finished,
+		Args:     j.maskedArgs(),
+		Plan:     j.plan,
+		Init:     j.initStatus,
+	}
+	if record.Status == "" {
+		record.Status = "never-ran"
+	}
+	if j.started.IsZero() {
+		record.ExitCode = -1
 	}
-	return fmt.Sprintf("%s: %s", j.Name, j.result)
+	return record
 }
@@ -6,10 +6,15 @@ import (
 	"bytes"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/scaleoutllc/terrallel/internal/terraform"
 )
 
@@ -40,3 +45,694 @@ func TestJobCancel(t *testing.T) {
 		t.Errorf("expected result %s, got %s with error: %s", expectedResult, job.Result(), jobErr)
 	}
 }
+
+func TestJobAbort(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	dir, _ := os.Getwd()
+	job := &terraform.Job{
+		Name:   "test-abort",
+		Bin:    filepath.Join(dir, "mock", "dist", "mock.exe"),
+		Args:   []string{},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	var jobErr error
+	go func() {
+		defer wg.Done()
+		jobErr = job.Run(false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := job.Abort("cancelled due to failure elsewhere"); err != nil {
+		t.Fatalf("Unexpected error aborting, %s", err)
+	}
+	wg.Wait()
+	expectedResult := "test-abort: cancelled due to failure elsewhere"
+	if job.Result() != expectedResult {
+		t.Errorf("expected result %s, got %s with error: %s", expectedResult, job.Result(), jobErr)
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name     string
+		script   string
+		retry    terraform.Retry
+		expected string
+	}{
+		{
+			name:     "retries every failure without match",
+			script:   "exit 1",
+			retry:    terraform.Retry{Attempts: 2, Backoff: time.Millisecond},
+			expected: "test-retry: failed (previous attempts: failed, failed)",
+		},
+		{
+			name:   "retries matching failures",
+			script: "echo 'Error acquiring the state lock' >&2; exit 1",
+			retry: terraform.Retry{
+				Attempts: 1,
+				Match:    []*regexp.Regexp{regexp.MustCompile("state lock")},
+			},
+			expected: "test-retry: failed (previous attempts: failed)",
+		},
+		{
+			name:   "does not retry other failures",
+			script: "echo 'Error: invalid reference' >&2; exit 1",
+			retry: terraform.Retry{
+				Attempts: 1,
+				Match:    []*regexp.Regexp{regexp.MustCompile("state lock")},
+			},
+			expected: "test-retry: failed",
+		},
+		{
+			name:     "stops retrying after success",
+			script:   "test -f marker && exit 0; touch marker; exit 1",
+			retry:    terraform.Retry{Attempts: 3},
+			expected: "test-retry: success (previous attempts: failed)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(basedir, "test-retry"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			job := &terraform.Job{
+				Name:    "test-retry",
+				Basedir: basedir,
+				Bin:     "sh",
+				Args:    []string{"-c", test.script},
+				Retry:   test.retry,
+				Stdout:  &stdout,
+				Stderr:  &stderr,
+			}
+			job.Run(false)
+			if job.Result() != test.expected {
+				t.Errorf("expected result %s, got %s", test.expected, job.Result())
+			}
+		})
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{
+			name:   "interrupted",
+			script: "sleep 5",
+		},
+		{
+			name:   "escalates when interrupt is ignored",
+			script: "trap '' INT; sleep 5",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(basedir, "test-timeout"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			job := &terraform.Job{
+				Name:    "test-timeout",
+				Basedir: basedir,
+				Bin:     "sh",
+				Args:    []string{"-c", test.script},
+				Timeout: 50 * time.Millisecond,
+				Grace:   50 * time.Millisecond,
+				Stdout:  &stdout,
+				Stderr:  &stderr,
+			}
+			start := time.Now()
+			err := job.Run(false)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("expected job to be stopped, ran for %s", elapsed)
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "timed-out") {
+				t.Errorf("expected timed-out error, got %v", err)
+			}
+			expectedResult := "test-timeout: timed-out"
+			if job.Result() != expectedResult {
+				t.Errorf("expected result %s, got %s", expectedResult, job.Result())
+			}
+		})
+	}
+}
+
+func TestJobGrace(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name         string
+		timeoutsOnly bool
+		expectKilled bool
+	}{
+		{
+			name:         "escalates every stop",
+			expectKilled: true,
+		},
+		{
+			name:         "leaves interrupted jobs to exit by themselves",
+			timeoutsOnly: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(basedir, "test-grace"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			job := &terraform.Job{
+				Name:              "test-grace",
+				Basedir:           basedir,
+				Bin:               "sh",
+				Args:              []string{"-c", "trap '' INT; sleep 1; echo finished"},
+				Grace:             50 * time.Millisecond,
+				GraceTimeoutsOnly: test.timeoutsOnly,
+				Stdout:            &stdout,
+				Stderr:            &stderr,
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				job.Run(false)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			if err := job.Cancel(); err != nil {
+				t.Fatalf("unexpected error cancelling, %s", err)
+			}
+			<-done
+			if killed := !strings.Contains(stdout.String(), "finished"); killed != test.expectKilled {
+				t.Errorf("expected killed to be %t, got output %q", test.expectKilled, stdout.String())
+			}
+		})
+	}
+}
+
+func TestJobRecord(t *testing.T) {
+	requireShell(t)
+	var stdout, stderr bytes.Buffer
+	basedir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(basedir, "test-record"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	job := &terraform.Job{
+		Name:    "test-record",
+		Basedir: basedir,
+		Bin:     "sh",
+		Args:    []string{"-c", "exit 3"},
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if record := job.Record(); record.Status != "never-ran" || record.ExitCode != -1 {
+		t.Errorf("expected never-ran with exit code -1, got %s with %d", record.Status, record.ExitCode)
+	}
+	job.Run(false)
+	record := job.Record()
+	if record.Status != "failed" || record.ExitCode != 3 {
+		t.Errorf("expected failed with exit code 3, got %s with %d", record.Status, record.ExitCode)
+	}
+	if record.Started.IsZero() || record.Finished.Before(record.Started) {
+		t.Errorf("expected start and finish times, got %s and %s", record.Started, record.Finished)
+	}
+}
+
+func TestJobPlanSummary(t *testing.T) {
+	requireShell(t)
+	var stdout, stderr bytes.Buffer
+	basedir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(basedir, "test-plan"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(basedir, "terraform")
+	script := `#!/bin/sh
+if [ "$1" = show ]; then
+  echo '{"resource_changes":[
+    {"address":"a.new","change":{"actions":["create"]}},
+    {"address":"a.same","change":{"actions":["no-op"]}},
+    {"address":"a.changed","change":{"actions":["update"]}},
+    {"address":"a.replaced","change":{"actions":["delete","create"]}},
+    {"address":"a.gone","change":{"actions":["delete"]}}
+  ],"resource_drift":[
+    {"address":"a.drifted","change":{"actions":["update"]}},
+    {"address":"a.same","change":{"actions":["no-op"]}}
+  ]}'
+fi
+`
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	job := &terraform.Job{
+		Name:    "test-plan",
+		Basedir: basedir,
+		Bin:     bin,
+		Args:    []string{"plan", "-out=plan.tfplan"},
+		Plan:    "plan.tfplan",
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if err := job.Run(false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := &terraform.PlanSummary{
+		Add:       2,
+		Change:    1,
+		Destroy:   2,
+		Destroyed: []string{"a.replaced", "a.gone"},
+		Drifted:   []string{"a.drifted"},
+	}
+	if diff := cmp.Diff(expected, job.Record().Plan); diff != "" {
+		t.Errorf("plan summary does not match (-expected +got):\n%s", diff)
+	}
+	expectedResult := "test-plan: success (2 to add, 1 to change, 2 to destroy, 1 drifted)"
+	if job.Result() != expectedResult {
+		t.Errorf("expected result %s, got %s", expectedResult, job.Result())
+	}
+}
+
+func TestJobDetailedExitCode(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name     string
+		args     []string
+		backend  terraform.Backend
+		expected string
+		err      bool
+	}{
+		{
+			name:     "changes",
+			args:     []string{"-c", "exit 2", "-detailed-exitcode"},
+			expected: "test-detailed: changes",
+		},
+		{
+			name:     "no changes",
+			args:     []string{"-c", "exit 0", "-detailed-exitcode"},
+			expected: "test-detailed: no-changes",
+		},
+		{
+			name:     "error",
+			args:     []string{"-c", "exit 1", "-detailed-exitcode"},
+			expected: "test-detailed: failed",
+			err:      true,
+		},
+		{
+			name:     "exit code 2 without the flag",
+			args:     []string{"-c", "exit 2"},
+			expected: "test-detailed: failed",
+			err:      true,
+		},
+		{
+			name:     "exit code 2 from a command",
+			args:     []string{"-c", "exit 2", "-detailed-exitcode"},
+			backend:  terraform.Command,
+			expected: "test-detailed: failed",
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(basedir, "test-detailed"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			job := &terraform.Job{
+				Name:    "test-detailed",
+				Basedir: basedir,
+				Bin:     "sh",
+				Backend: test.backend,
+				Args:    test.args,
+				Stdout:  &stdout,
+				Stderr:  &stderr,
+			}
+			err := job.Run(false)
+			if (err != nil) != test.err {
+				t.Errorf("expected error %t, got %v", test.err, err)
+			}
+			if job.Result() != test.expected {
+				t.Errorf("expected result %s, got %s", test.expected, job.Result())
+			}
+			if job.Record().Succeeded() == test.err {
+				t.Errorf("expected succeeded to be %t", !test.err)
+			}
+		})
+	}
+}
+
+func TestJobEnv(t *testing.T) {
+	requireShell(t)
+	var stdout, stderr bytes.Buffer
+	basedir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(basedir, "test-env"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	job := &terraform.Job{
+		Name:    "test-env",
+		Basedir: basedir,
+		Bin:     "sh",
+		Args:    []string{"-c", "echo $AWS_PROFILE $TF_VAR_db_password"},
+		Env:     map[string]string{"AWS_PROFILE": "dev", "TF_VAR_db_password": "hunter2"},
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if err := job.Run(false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "[test-env]: dev hunter2\n"; stdout.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, stdout.String())
+	}
+	stdout.Reset()
+	if err := job.Run(true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dir := filepath.Join(basedir, "test-env")
+	expected := "AWS_PROFILE=dev TF_VAR_db_password=*** sh -c echo $AWS_PROFILE $TF_VAR_db_password (in " + dir + ")\n"
+	if stdout.String() != expected {
+		t.Errorf("expected dry run %q, got %q", expected, stdout.String())
+	}
+}
+
+func TestJobSecretVars(t *testing.T) {
+	requireShell(t)
+	var stdout, stderr bytes.Buffer
+	basedir := t.TempDir()
+	dir := filepath.Join(basedir, "test-vars")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(basedir, "terraform")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\necho \"$@\"\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	job := &terraform.Job{
+		Name:    "test-vars",
+		Basedir: basedir,
+		Bin:     bin,
+		Args:    []string{"plan", "-var=region=us-east-1", "-var=db_password=hunter2", "-var", "api_token=abc"},
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	masked := "plan -var=region=us-east-1 -var=db_password=*** -var api_token=***"
+	err := job.Run(false)
+	if expected := "[test-vars]: plan -var=region=us-east-1 -var=db_password=hunter2 -var api_token=abc\n"; stdout.String() != expected {
+		t.Errorf("expected terraform to be given %q, got %q", expected, stdout.String())
+	}
+	if err == nil || !strings.Contains(err.Error(), masked) || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("expected error to mask secrets, got %v", err)
+	}
+	if actual := strings.Join(job.Record().Args, " "); actual != masked {
+		t.Errorf("expected recorded args %q, got %q", masked, actual)
+	}
+	stdout.Reset()
+	job.Run(true)
+	if expected := bin + " " + masked + " (in " + dir + ")\n"; stdout.String() != expected {
+		t.Errorf("expected dry run %q, got %q", expected, stdout.String())
+	}
+}
+
+func TestJobAutoInit(t *testing.T) {
+	requireShell(t)
+	lock := `provider "registry.terraform.io/hashicorp/null" {
+  version = "3.2.1"
+}
+`
+	tests := []struct {
+		name     string
+		files    map[string]string
+		backend  terraform.Backend
+		failInit bool
+		expected string
+		init     string
+		err      bool
+	}{
+		{
+			name:     "never initialised",
+			files:    map[string]string{"main.tf": ""},
+			expected: "test-init: success (after init)",
+			init:     "success",
+		},
+		{
+			name: "initialised",
+			files: map[string]string{
+				".terraform.lock.hcl": lock,
+				".terraform/providers/registry.terraform.io/hashicorp/null/3.2.1/linux_amd64/provider": "",
+				".terraform/modules/modules.json": `{"Modules":[{"Key":"","Dir":"."},{"Key":"vpc","Dir":".terraform/modules/vpc"}]}`,
+				"main.tf":                         `module "vpc" { source = "./vpc" }`,
+			},
+			expected: "test-init: success",
+		},
+		{
+			name: "provider version not installed",
+			files: map[string]string{
+				".terraform.lock.hcl": lock,
+				".terraform/providers/registry.terraform.io/hashicorp/null/3.1.0/linux_amd64/provider": "",
+			},
+			expected: "test-init: success (after init)",
+			init:     "success",
+		},
+		{
+			name: "module not installed",
+			files: map[string]string{
+				".terraform/terraform.tfstate": "",
+				"main.tf":                      `module "vpc" { source = "./vpc" }`,
+			},
+			expected: "test-init: success (after init)",
+			init:     "success",
+		},
+		{
+			name:     "init fails",
+			files:    map[string]string{"main.tf": ""},
+			failInit: true,
+			expected: "test-init: init-failed",
+			init:     "failed",
+			err:      true,
+		},
+		{
+			name:     "left to terragrunt",
+			files:    map[string]string{"terragrunt.hcl": ""},
+			backend:  terraform.Terragrunt,
+			expected: "test-init: success",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			dir := filepath.Join(basedir, "test-init")
+			for name, content := range test.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bin := filepath.Join(basedir, "terraform")
+			script := "#!/bin/sh\nif [ \"$1\" = init ]; then\n  [ -n \"$FAIL_INIT\" ] && exit 1\n  mkdir -p .terraform\nfi\n"
+			if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			env := map[string]string{}
+			if test.failInit {
+				env["FAIL_INIT"] = "1"
+			}
+			job := &terraform.Job{
+				Name:     "test-init",
+				Basedir:  basedir,
+				Bin:      bin,
+				Backend:  test.backend,
+				Args:     []string{"plan"},
+				Env:      env,
+				AutoInit: true,
+				Stdout:   &stdout,
+				Stderr:   &stderr,
+			}
+			err := job.Run(false)
+			if (err != nil) != test.err {
+				t.Errorf("expected error %t, got %v", test.err, err)
+			}
+			if job.Result() != test.expected {
+				t.Errorf("expected result %s, got %s", test.expected, job.Result())
+			}
+			if job.Record().Init != test.init {
+				t.Errorf("expected init %q, got %q", test.init, job.Record().Init)
+			}
+		})
+	}
+}
+
+func TestJobWorkspace(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name     string
+		args     []string
+		backend  terraform.Backend
+		expected []string
+	}{
+		{
+			name: "created before running",
+			args: []string{"plan"},
+			expected: []string{
+				"workspace select -or-create stage in ",
+				"plan in stage",
+			},
+		},
+		{
+			name:     "not created for init",
+			args:     []string{"init"},
+			expected: []string{"init in stage"},
+		},
+		{
+			name:     "not created through terragrunt",
+			args:     []string{"plan"},
+			backend:  terraform.Terragrunt,
+			expected: []string{"plan in stage"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(basedir, "test-ws"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			bin := filepath.Join(basedir, "terraform")
+			script := "#!/bin/sh\necho \"$* in $TF_WORKSPACE\" >> ../log\n"
+			if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			job := &terraform.Job{
+				Name:      "test-ws",
+				Basedir:   basedir,
+				Bin:       bin,
+				Backend:   test.backend,
+				Args:      test.args,
+				Workspace: "stage",
+				Stdout:    &stdout,
+				Stderr:    &stderr,
+			}
+			if err := job.Run(false); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			log, err := os.ReadFile(filepath.Join(basedir, "log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, strings.Split(strings.TrimSpace(string(log)), "\n")); diff != "" {
+				t.Errorf("commands do not match (-expected +got):\n%s", diff)
+			}
+			if expected := "test-ws@stage: success"; job.Result() != expected {
+				t.Errorf("expected result %s, got %s", expected, job.Result())
+			}
+		})
+	}
+}
+
+// requireShell skips tests which stand in for terraform with a POSIX shell
+// script, as windows cannot run them.
+func requireShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+}
+
+func TestBackendOf(t *testing.T) {
+	tests := map[string]terraform.Backend{
+		"terraform":                   terraform.Terraform,
+		"/usr/local/bin/tofu":         terraform.OpenTofu,
+		"terragrunt":                  terraform.Terragrunt,
+		"terragrunt.exe":              terraform.Terragrunt,
+		"./scripts/terraform-wrapper": terraform.Terraform,
+	}
+	for bin, expected := range tests {
+		if got := terraform.BackendOf(bin); got != expected {
+			t.Errorf("expected %s to be %s, got %s", bin, expected, got)
+		}
+	}
+}
+
+func TestJobSharedDirectory(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name     string
+		args     []string
+		autoInit bool
+		expected []string
+	}{
+		{
+			name:     "init",
+			args:     []string{"init"},
+			expected: []string{"init", "init"},
+		},
+		{
+			name:     "auto-init once",
+			args:     []string{"plan"},
+			autoInit: true,
+			expected: []string{"init", "plan", "plan", "workspace", "workspace"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			basedir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(basedir, "test-shared"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			// init and workspace fail when another is changing the
+			// directory at the same time.
+			bin := filepath.Join(basedir, "terraform")
+			script := "#!/bin/sh\necho $1 >> ../log\n" +
+				"case $1 in init|workspace)\n" +
+				"  mkdir ../busy || exit 1\n  sleep 0.1\n  mkdir -p .terraform\n  rmdir ../busy\n" +
+				"esac\n"
+			if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			var jobs []*terraform.Job
+			for _, workspace := range []string{"dev", "stage"} {
+				jobs = append(jobs, &terraform.Job{
+					Name:      "test-shared",
+					Basedir:   basedir,
+					Bin:       bin,
+					Args:      test.args,
+					Workspace: workspace,
+					AutoInit:  test.autoInit,
+					Stdout:    &stdout,
+					Stderr:    &stderr,
+				})
+			}
+			errs := make([]error, len(jobs))
+			wg := &sync.WaitGroup{}
+			for i, job := range jobs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[i] = job.Run(false)
+				}()
+			}
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}
+			log, err := os.ReadFile(filepath.Join(basedir, "log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+			sort.Strings(lines)
+			if diff := cmp.Diff(test.expected, lines); diff != "" {
+				t.Errorf("commands do not match (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
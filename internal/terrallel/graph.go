@@ -0,0 +1,460 @@
+package terrallel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// graph is the dependency graph compiled from a Tree. Every job becomes a
+// node which starts as soon as all of the nodes it depends on have succeeded
+// rather than waiting for every sibling at the same level of the tree. A job
+// appearing in more than one place in the tree is a single node depending on
+// the predecessors of every place it appears.
+type graph struct {
+	nodes []*node
+	index map[Job]*node
+}
+
+type node struct {
+	job    Job
+	labels map[string]string
+	deps   []*node
+	// after are nodes which must finish before this one starts but whose
+	// failure does not stop it.
+	after []*node
+	done  chan struct{}
+	ok    bool
+	// failed is set when the job, or something it depends on, failed.
+	failed bool
+}
+
+func (g *graph) add(job Job, labels map[string]string, deps []*node) *node {
+	if n, ok := g.index[job]; ok {
+		n.deps = append(n.deps, deps...)
+		return n
+	}
+	if g.index == nil {
+		g.index = map[Job]*node{}
+	}
+	n := &node{
+		job:    job,
+		labels: labels,
+		deps:   deps,
+		done:   make(chan struct{}),
+	}
+	g.nodes = append(g.nodes, n)
+	g.index[job] = n
+	return n
+}
+
+// compile builds the graph of the tree for running forward or in reverse.
+func (t *Tree) compile(reverse bool) *graph {
+	g := &graph{}
+	if reverse {
+		t.reverse(g, nil)
+	} else {
+		t.forward(g, nil)
+	}
+	return g
+}
+
+// first moves the nodes of the given jobs ahead of every other node. They
+// lose their own dependencies and run one after another, and everything else
+// waits for them to finish.
+func (g *graph) first(jobs map[Job]bool) {
+	var first []*node
+	for _, n := range g.nodes {
+		if jobs[n.job] {
+			n.deps = nil
+			n.after = first
+			first = append(first, n)
+		}
+	}
+	for _, n := range g.nodes {
+		if !jobs[n.job] {
+			n.after = first
+		}
+	}
+}
+
+// Dependents returns the given jobs along with every job depending on them,
+// directly or through other jobs, when the tree is run in the given direction.
+func (t *Tree) Dependents(reverse bool, jobs []Job) map[Job]bool {
+	g := t.compile(reverse)
+	dependents := map[*node][]*node{}
+	for _, n := range g.nodes {
+		for _, dep := range n.deps {
+			dependents[dep] = append(dependents[dep], n)
+		}
+	}
+	return g.walk(jobs, func(n *node) []*node { return dependents[n] })
+}
+
+// Dependencies returns the given jobs along with every job they depend on,
+// directly or through other jobs, when the tree is run in the given direction.
+func (t *Tree) Dependencies(reverse bool, jobs []Job) map[Job]bool {
+	g := t.compile(reverse)
+	return g.walk(jobs, func(n *node) []*node { return n.deps })
+}
+
+// walk collects the jobs reachable from the given jobs by following edges.
+func (g *graph) walk(jobs []Job, edges func(*node) []*node) map[Job]bool {
+	found := map[Job]bool{}
+	var visit func(n *node)
+	visit = func(n *node) {
+		if found[n.job] {
+			return
+		}
+		found[n.job] = true
+		for _, next := range edges(n) {
+			visit(next)
+		}
+	}
+	for _, job := range jobs {
+		if n, ok := g.index[job]; ok {
+			visit(n)
+		}
+	}
+	return found
+}
+
+// forward adds the jobs of the tree to the graph in the order groups, jobs,
+// next. The returned nodes are those which must complete before anything
+// that depends on the tree as a whole can start.
+func (t *Tree) forward(g *graph, after []*node) []*node {
+	exits := after
+	if len(t.Group) != 0 {
+		exits = nil
+		for _, child := range t.Group {
+			exits = append(exits, child.forward(g, after)...)
+		}
+	}
+	exits = t.jobs(g, exits)
+	if t.Next != nil {
+		return t.Next.forward(g, exits)
+	}
+	return exits
+}
+
+// reverse adds the jobs of the tree to the graph in the order next, jobs,
+// groups. This is used to tear down what forward would build.
+func (t *Tree) reverse(g *graph, after []*node) []*node {
+	exits := after
+	if t.Next != nil {
+		exits = t.Next.reverse(g, exits)
+	}
+	exits = t.jobs(g, exits)
+	if len(t.Group) != 0 {
+		groupExits := []*node{}
+		for _, child := range t.Group {
+			groupExits = append(groupExits, child.reverse(g, exits)...)
+		}
+		exits = groupExits
+	}
+	return exits
+}
+
+func (t *Tree) jobs(g *graph, after []*node) []*node {
+	if len(t.Jobs) == 0 {
+		return after
+	}
+	nodes := make([]*node, len(t.Jobs))
+	for i, job := range t.Jobs {
+		var labels map[string]string
+		if i < len(t.Labels) {
+			labels = t.Labels[i]
+		}
+		nodes[i] = g.add(job, labels, after)
+	}
+	return nodes
+}
+
+// run executes every node in the graph once its dependencies have succeeded.
+// Nodes depending on a failure are never started and, unless KeepGoing is
+// set, nothing else is started after the first failure either. Cancelling the
+// context, or a failure when FailFast is set, interrupts running jobs and
+// prevents any more from starting.
+func (g *graph) run(ctx context.Context, opts Options) error {
+	if err := g.checkCycles(); err != nil {
+		return err
+	}
+	global := newPool("parallelism", opts.Parallelism)
+	labelPools := map[string]*pool{}
+	for key, values := range opts.Pools {
+		for value, limit := range values {
+			name := fmt.Sprintf("%s=%s", key, value)
+			labelPools[name] = newPool(name, limit)
+		}
+	}
+	// with FailFast the first failure cancels a context shared by every job
+	// so running jobs are interrupted the same way as when the user cancels.
+	userCtx := ctx
+	ctx, failed := context.WithCancel(ctx)
+	defer failed()
+	halt := make(chan struct{})
+	haltOnce := &sync.Once{}
+	var mu sync.Mutex
+	var errs []string
+	wg := &sync.WaitGroup{}
+	for _, n := range g.nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			// dependents must be able to see this node failed before the
+			// rest of the run is halted because of it.
+			defer func() {
+				if n.failed && !opts.KeepGoing {
+					haltOnce.Do(func() { close(halt) })
+					if opts.FailFast {
+						failed()
+					}
+				}
+			}()
+			defer close(n.done)
+			ready, depFailed := n.wait(ctx, halt)
+			if opts.Exclude[n.job] {
+				if excluder, ok := n.job.(Excluder); ok {
+					excluder.Exclude()
+				}
+				n.ok = ready
+				n.failed = depFailed
+				return
+			}
+			if !ready {
+				if depFailed {
+					n.failed = true
+					if skipper, ok := n.job.(Skipper); ok {
+						skipper.Skip("dependency failed")
+					}
+				}
+				return
+			}
+			// label pools are taken before the global pool so a job waiting
+			// on a busy label never holds a slot other jobs could use.
+			pools := append(n.pools(labelPools), global)
+			for i, p := range pools {
+				if !n.acquire(ctx, halt, p) {
+					for _, held := range pools[:i] {
+						held.release()
+					}
+					return
+				}
+			}
+			defer func() {
+				for _, p := range pools {
+					p.release()
+				}
+			}()
+			var err error
+			runCh := make(chan error, 1)
+			go func() {
+				runCh <- n.job.Run(opts.DryRun)
+			}()
+			select {
+			case <-ctx.Done():
+				aborter, ok := n.job.(Aborter)
+				switch {
+				case ok && errors.Is(userCtx.Err(), context.DeadlineExceeded):
+					err = aborter.Abort("timed-out")
+				case ok && userCtx.Err() == nil:
+					err = aborter.Abort("cancelled due to failure elsewhere")
+				default:
+					err = n.job.Cancel()
+				}
+				// the job may still be escalating to harsher signals, which
+				// only happens while the process running it is alive.
+				if opts.StopWait > 0 {
+					select {
+					case <-runCh:
+					case <-time.After(opts.StopWait):
+					}
+				}
+			case err = <-runCh:
+				n.ok = err == nil
+				n.failed = !n.ok
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err.Error())
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// pool limits how many jobs may run at once. A pool without a limit never
+// blocks.
+type pool struct {
+	name  string
+	limit int
+	slots chan struct{}
+}
+
+func newPool(name string, limit int) *pool {
+	p := &pool{name: name, limit: limit}
+	if limit > 0 {
+		p.slots = make(chan struct{}, limit)
+	}
+	return p
+}
+
+func (p *pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// pools returns the label pools which apply to the job, in a stable order so
+// jobs sharing several labels always acquire them the same way.
+func (n *node) pools(labelPools map[string]*pool) []*pool {
+	var names []string
+	for key, value := range n.labels {
+		name := fmt.Sprintf("%s=%s", key, value)
+		if _, ok := labelPools[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	pools := make([]*pool, len(names))
+	for i, name := range names {
+		pools[i] = labelPools[name]
+	}
+	return pools
+}
+
+// acquire takes a slot from the pool, letting the job know it is queued if
+// none are free. It reports false if the context is cancelled while waiting.
+func (n *node) acquire(ctx context.Context, halt <-chan struct{}, p *pool) bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if queuer, ok := n.job.(Queuer); ok {
+		queuer.Queued(fmt.Sprintf("%s limit of %d reached", p.name, p.limit))
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-halt:
+		return false
+	}
+}
+
+// wait blocks until every dependency of the node has finished, reporting
+// whether the node is clear to run and, if not, whether that is because one
+// of its dependencies failed.
+func (n *node) wait(ctx context.Context, halt <-chan struct{}) (bool, bool) {
+	for _, before := range n.after {
+		select {
+		case <-ctx.Done():
+			return false, n.depFailed()
+		case <-halt:
+			return false, n.depFailed()
+		case <-before.done:
+		}
+	}
+	for _, dep := range n.deps {
+		select {
+		case <-ctx.Done():
+			return false, n.depFailed()
+		case <-halt:
+			return false, n.depFailed()
+		case <-dep.done:
+		}
+		if !dep.ok {
+			return false, dep.failed
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return false, false
+	case <-halt:
+		return false, false
+	default:
+		return true, false
+	}
+}
+
+// depFailed reports whether anything the node depends on, directly or
+// transitively, has already finished unsuccessfully.
+func (n *node) depFailed() bool {
+	seen := map[*node]bool{}
+	var check func(*node) bool
+	check = func(n *node) bool {
+		for _, dep := range n.deps {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			select {
+			case <-dep.done:
+				if dep.failed {
+					return true
+				}
+			default:
+			}
+			if check(dep) {
+				return true
+			}
+		}
+		return false
+	}
+	return check(n)
+}
+
+// checkCycles ensures no node depends on itself, which can only happen when a
+// shared workspace appears both before and after another in the same tree.
+func (g *graph) checkCycles() error {
+	if n := g.cycle(); n != nil {
+		return fmt.Errorf("dependency cycle detected at %s", n.job.Result())
+	}
+	return nil
+}
+
+// cycle returns a node which depends on itself, or nil when there is none.
+func (g *graph) cycle() *node {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := map[*node]int{}
+	var visit func(*node) *node
+	visit = func(n *node) *node {
+		switch state[n] {
+		case visiting:
+			return n
+		case visited:
+			return nil
+		}
+		state[n] = visiting
+		for _, dep := range n.deps {
+			if found := visit(dep); found != nil {
+				return found
+			}
+		}
+		state[n] = visited
+		return nil
+	}
+	for _, n := range g.nodes {
+		if found := visit(n); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+package terrallel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"github.com/zclconf/go-cty/cty/gocty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"gopkg.in/yaml.v3"
+)
+
+var hclFileSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "terrallel"},
+		{Type: "locals"},
+		{Type: "resource", LabelNames: []string{"type", "name"}},
+	},
+}
+
+var hclTargetSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "for_each"},
+		{Name: "labels"},
+		{Name: "env"},
+		{Name: "terraform_workspace"},
+		{Name: "group"},
+		{Name: "workspaces"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "next"},
+	},
+}
+
+var hclNextSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "labels"},
+		{Name: "env"},
+		{Name: "terraform_workspace"},
+		{Name: "group"},
+		{Name: "workspaces"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "next"},
+	},
+}
+
+type hclConfig struct {
+	Basedir     string                    `hcl:"basedir,optional"`
+	Import      []string                  `hcl:"import,optional"`
+	Parallelism int                       `hcl:"parallelism,optional"`
+	Binary      string                    `hcl:"binary,optional"`
+	PluginCache string                    `hcl:"plugin_cache,optional"`
+	Pools       map[string]map[string]int `hcl:"pools,optional"`
+	Retry       cty.Value                 `hcl:"retry,optional"`
+	Timeout     string                    `hcl:"timeout,optional"`
+	JobTimeout  string                    `hcl:"job_timeout,optional"`
+	Grace       string                    `hcl:"grace,optional"`
+}
+
+// hclResource is a resource "target" block whose body has been checked
+// against the schema but not yet evaluated.
+type hclResource struct {
+	name    string
+	content *hcl.BodyContent
+	keys    []string
+	each    map[string]cty.Value
+}
+
+func isHCL(path string) bool {
+	switch filepath.Ext(path) {
+	case ".hcl", ".tf":
+		return true
+	}
+	return false
+}
+
+// newFromHCL compiles a manifest written as terraform-style resource
+// "target" blocks into the same target tree produced by the YAML format.
+func newFromHCL(path string) (*Terrallel, error) {
+	t := &Terrallel{
+		Manifest: map[string]*Target{},
+		Config:   &Config{},
+	}
+	manifest, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+	root, diags := parseHCL(manifest, path)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("parsing manifest %s: %w", path, diags)
+	}
+	for _, block := range root.Blocks.OfType("terrallel") {
+		config := &hclConfig{}
+		if diags := gohcl.DecodeBody(block.Body, nil, config); diags.HasErrors() {
+			return nil, fmt.Errorf("parsing manifest %s: %w", path, diags)
+		}
+		t.Config.Basedir = config.Basedir
+		t.Config.Import = config.Import
+		t.Config.Parallelism = config.Parallelism
+		t.Config.Binary = config.Binary
+		t.Config.PluginCache = config.PluginCache
+		t.Config.Pools = config.Pools
+		for _, d := range []struct {
+			value string
+			out   *time.Duration
+		}{
+			{config.Timeout, &t.Config.Timeout},
+			{config.JobTimeout, &t.Config.JobTimeout},
+		} {
+			if d.value == "" {
+				continue
+			}
+			if *d.out, err = time.ParseDuration(d.value); err != nil {
+				return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+			}
+		}
+		if config.Grace != "" {
+			grace, err := time.ParseDuration(config.Grace)
+			if err != nil {
+				return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+			}
+			t.Config.Grace = &grace
+		}
+		if !config.Retry.IsNull() {
+			t.Config.Retry = &Retry{}
+			if err := hclDecodeYAML(config.Retry, t.Config.Retry); err != nil {
+				return nil, fmt.Errorf("parsing manifest %s: retry: %w", path, err)
+			}
+		}
+	}
+	if t.Config.Import == nil {
+		t.Config.Import = []string{}
+	}
+	paths, err := importPaths(filepath.Dir(path), t.Config.Import)
+	if err != nil {
+		return nil, fmt.Errorf("reading import files: %w", err)
+	}
+	files := []*hcl.BodyContent{root}
+	for _, importPath := range paths {
+		content, err := os.ReadFile(importPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading import files: reading import %s: %w", importPath, err)
+		}
+		file, diags := parseHCL(content, importPath)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("parsing imports: %w", diags)
+		}
+		files = append(files, file)
+	}
+	unresolved, err := newUnresolvedHCL(files)
+	if err != nil {
+		return nil, fmt.Errorf("parsing imports: %w", err)
+	}
+	if err := t.resolve(unresolved); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseHCL(src []byte, filename string) (*hcl.BodyContent, hcl.Diagnostics) {
+	file, diags := hclsyntax.ParseConfig(src, filename, hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return file.Body.Content(hclFileSchema)
+}
+
+func newUnresolvedHCL(files []*hcl.BodyContent) (unresolved, error) {
+	locals, err := hclLocals(files)
+	if err != nil {
+		return nil, err
+	}
+	var resources []*hclResource
+	namespace := map[string]cty.Value{}
+	for _, file := range files {
+		for _, block := range file.Blocks.OfType("resource") {
+			if block.Labels[0] != "target" {
+				return nil, fmt.Errorf("%s: unsupported resource type %q", block.DefRange, block.Labels[0])
+			}
+			name := block.Labels[1]
+			if _, exists := namespace[name]; exists {
+				return nil, fmt.Errorf("duplicate: %s", name)
+			}
+			content, diags := block.Body.Content(hclTargetSchema)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			resource := &hclResource{
+				name:    name,
+				content: content,
+			}
+			if err := resource.expand(locals); err != nil {
+				return nil, err
+			}
+			namespace[name] = resource.value()
+			resources = append(resources, resource)
+		}
+	}
+	all := unresolved{}
+	for _, resource := range resources {
+		ctx := &hcl.EvalContext{
+			Variables: map[string]cty.Value{
+				"local": locals,
+				"resource": cty.ObjectVal(map[string]cty.Value{
+					"target": cty.ObjectVal(namespace),
+				}),
+			},
+			Functions: hclFunctions,
+		}
+		if resource.each == nil {
+			target, diags := decodeHCLTarget(resource.content, ctx)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			all[resource.name] = target
+			continue
+		}
+		for _, key := range resource.keys {
+			ctx.Variables["each"] = cty.ObjectVal(map[string]cty.Value{
+				"key":   cty.StringVal(key),
+				"value": resource.each[key],
+			})
+			target, diags := decodeHCLTarget(resource.content, ctx)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			name := instanceName(resource.name, key)
+			if _, exists := all[name]; exists {
+				return nil, fmt.Errorf("duplicate: %s", name)
+			}
+			all[name] = target
+		}
+	}
+	return all, nil
+}
+
+// hclLocals evaluates every locals block across all files. Locals may refer
+// to each other so they are evaluated repeatedly until no more progress can
+// be made.
+func hclLocals(files []*hcl.BodyContent) (cty.Value, error) {
+	pending := map[string]*hcl.Attribute{}
+	for _, file := range files {
+		for _, block := range file.Blocks.OfType("locals") {
+			attrs, diags := block.Body.JustAttributes()
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+			for name, attr := range attrs {
+				if _, exists := pending[name]; exists {
+					return cty.NilVal, fmt.Errorf("duplicate local: %s", name)
+				}
+				pending[name] = attr
+			}
+		}
+	}
+	values := map[string]cty.Value{}
+	for len(pending) != 0 {
+		progress := false
+		for name, attr := range pending {
+			if !localsReady(attr.Expr, values) {
+				continue
+			}
+			ctx := &hcl.EvalContext{
+				Variables: map[string]cty.Value{"local": cty.ObjectVal(values)},
+				Functions: hclFunctions,
+			}
+			value, diags := attr.Expr.Value(ctx)
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+			values[name] = value
+			delete(pending, name)
+			progress = true
+		}
+		if !progress {
+			var names []string
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return cty.NilVal, fmt.Errorf("unable to resolve locals (missing or circular reference): %v", names)
+		}
+	}
+	return cty.ObjectVal(values), nil
+}
+
+func localsReady(expr hcl.Expression, values map[string]cty.Value) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		if attr, ok := traversal[1].(hcl.TraverseAttr); ok {
+			if _, ok := values[attr.Name]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// expand evaluates for_each, if present, into the keys and values each
+// instance of the target will be decoded with.
+func (r *hclResource) expand(locals cty.Value) error {
+	attr, ok := r.content.Attributes["for_each"]
+	if !ok {
+		return nil
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{"local": locals},
+		Functions: hclFunctions,
+	}
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return diags
+	}
+	ty := value.Type()
+	if value.IsNull() || !(ty.IsSetType() || ty.IsMapType() || ty.IsObjectType()) {
+		return fmt.Errorf("%s: for_each on target %s must be a set of strings or a map", attr.Range, r.name)
+	}
+	r.each = map[string]cty.Value{}
+	for it := value.ElementIterator(); it.Next(); {
+		key, val := it.Element()
+		if ty.IsSetType() {
+			if !val.Type().Equals(cty.String) {
+				return fmt.Errorf("%s: for_each on target %s must be a set of strings", attr.Range, r.name)
+			}
+			key = val
+		}
+		r.keys = append(r.keys, key.AsString())
+		r.each[key.AsString()] = val
+	}
+	return nil
+}
+
+// value is how the target is exposed to expressions as resource.target.NAME:
+// the name of the target, or a map of keys to instance names for targets
+// using for_each.
+func (r *hclResource) value() cty.Value {
+	if r.each == nil {
+		return cty.StringVal(r.name)
+	}
+	if len(r.keys) == 0 {
+		return cty.MapValEmpty(cty.String)
+	}
+	instances := map[string]cty.Value{}
+	for _, key := range r.keys {
+		instances[key] = cty.StringVal(instanceName(r.name, key))
+	}
+	return cty.MapVal(instances)
+}
+
+func instanceName(name string, key string) string {
+	return fmt.Sprintf("%s[%s]", name, key)
+}
+
+func decodeHCLTarget(content *hcl.BodyContent, ctx *hcl.EvalContext) (*target, hcl.Diagnostics) {
+	t := &target{}
+	var diags hcl.Diagnostics
+	if attr, ok := content.Attributes["group"]; ok {
+		if t.Group, diags = hclTargetNames(attr, ctx); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if attr, ok := content.Attributes["workspaces"]; ok {
+		if t.Workspaces, diags = hclWorkspaces(attr, ctx); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if attr, ok := content.Attributes["labels"]; ok {
+		if t.Labels, diags = hclStringMap(attr, ctx); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if attr, ok := content.Attributes["env"]; ok {
+		if t.Env, diags = hclStringMap(attr, ctx); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if attr, ok := content.Attributes["terraform_workspace"]; ok {
+		if diags = gohcl.DecodeExpression(attr.Expr, ctx, &t.TerraformWorkspace); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	for _, block := range content.Blocks.OfType("next") {
+		if t.Next != nil {
+			return nil, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate next block",
+				Detail:   "Only one next block is allowed per level.",
+				Subject:  &block.DefRange,
+			}}
+		}
+		next, diags := block.Body.Content(hclNextSchema)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if t.Next, diags = decodeHCLTarget(next, ctx); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	return t, nil
+}
+
+// hclTargetNames flattens a group expression into target names. Referencing
+// a target that uses for_each directly includes every one of its instances.
+func hclTargetNames(attr *hcl.Attribute, ctx *hcl.EvalContext) ([]string, hcl.Diagnostics) {
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var names []string
+	var walk func(cty.Value) bool
+	walk = func(v cty.Value) bool {
+		switch {
+		case v.IsNull() || !v.IsKnown():
+			return false
+		case v.Type() == cty.String:
+			names = append(names, v.AsString())
+		case v.CanIterateElements():
+			for it := v.ElementIterator(); it.Next(); {
+				if _, el := it.Element(); !walk(el) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+		return true
+	}
+	if !walk(value) {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Incorrect attribute value type",
+			Detail:   fmt.Sprintf("%s must be a list of targets.", attr.Name),
+			Subject:  &attr.Range,
+		}}
+	}
+	return names, nil
+}
+
+// hclWorkspaces decodes a list of workspaces, each either a path or an
+// object using the same keys as a workspace in the YAML format.
+func hclWorkspaces(attr *hcl.Attribute, ctx *hcl.EvalContext) ([]Workspace, hcl.Diagnostics) {
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if value.IsNull() {
+		return nil, nil
+	}
+	fail := func(err error) hcl.Diagnostics {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Incorrect attribute value type",
+			Detail:   fmt.Sprintf("%s must be a list of paths or workspace objects: %s.", attr.Name, err),
+			Subject:  &attr.Range,
+		}}
+	}
+	ty := value.Type()
+	if !(ty.IsListType() || ty.IsTupleType() || ty.IsSetType()) || !value.IsWhollyKnown() {
+		return nil, fail(fmt.Errorf("got %s", ty.FriendlyName()))
+	}
+	var workspaces []Workspace
+	for it := value.ElementIterator(); it.Next(); {
+		_, el := it.Element()
+		var ws Workspace
+		if err := hclDecodeYAML(el, &ws); err != nil {
+			return nil, fail(err)
+		}
+		if ws.Path == "" {
+			return nil, fail(fmt.Errorf("workspace path is required"))
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, nil
+}
+
+// hclDecodeYAML decodes a value into a type which knows how to read itself
+// from the YAML format so both formats accept the same shapes.
+func hclDecodeYAML(value cty.Value, out interface{}) error {
+	encoded, err := ctyjson.Marshal(value, value.Type())
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(encoded, out)
+}
+
+func hclStringMap(attr *hcl.Attribute, ctx *hcl.EvalContext) (map[string]string, hcl.Diagnostics) {
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if value.IsNull() {
+		return nil, nil
+	}
+	value, err := convert.Convert(value, cty.Map(cty.String))
+	if err == nil {
+		var result map[string]string
+		if err = gocty.FromCtyValue(value, &result); err == nil {
+			return result, nil
+		}
+	}
+	return nil, hcl.Diagnostics{{
+		Severity: hcl.DiagError,
+		Summary:  "Incorrect attribute value type",
+		Detail:   fmt.Sprintf("%s must be a map of strings: %s.", attr.Name, err),
+		Subject:  &attr.Range,
+	}}
+}
+
+var hclFunctions = map[string]function.Function{
+	"concat":   stdlib.ConcatFunc,
+	"distinct": stdlib.DistinctFunc,
+	"flatten":  stdlib.FlattenFunc,
+	"format":   stdlib.FormatFunc,
+	"join":     stdlib.JoinFunc,
+	"keys":     stdlib.KeysFunc,
+	"length":   stdlib.LengthFunc,
+	"lower":    stdlib.LowerFunc,
+	"merge":    stdlib.MergeFunc,
+	"replace":  stdlib.ReplaceFunc,
+	"sort":     stdlib.SortFunc,
+	"tolist":   convertFunc(cty.List(cty.DynamicPseudoType)),
+	"toset":    convertFunc(cty.Set(cty.DynamicPseudoType)),
+	"upper":    stdlib.UpperFunc,
+	"values":   stdlib.ValuesFunc,
+}
+
+func convertFunc(ty cty.Type) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "v", Type: cty.DynamicPseudoType},
+		},
+		Type: function.StaticReturnType(cty.DynamicPseudoType),
+		Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+			return convert.Convert(args[0], ty)
+		},
+	})
+}
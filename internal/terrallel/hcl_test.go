@@ -0,0 +1,309 @@
+package terrallel_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+func TestNewHCL(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    string
+		imports     map[string]string
+		expected    map[string]*terrallel.Target
+		expectedErr string
+	}{
+		{
+			name:        "no manifest",
+			expectedErr: "reading",
+		},
+		{
+			name: "nested next blocks",
+			manifest: `
+resource "target" "t1" {
+  workspaces = ["t1ws1", "t1ws2"]
+  next {
+    workspaces = ["t1ws3"]
+  }
+}`,
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name:       "t1",
+					Workspaces: []terrallel.Workspace{{Path: "t1ws1"}, {Path: "t1ws2"}},
+					Next: &terrallel.Target{
+						Name:       "next",
+						Workspaces: []terrallel.Workspace{{Path: "t1ws3"}},
+					},
+				},
+			},
+		},
+		{
+			name: "malformed hcl",
+			manifest: `
+resource "target" {
+`,
+			expectedErr: "parsing manifest",
+		},
+		{
+			name: "unsupported resource type",
+			manifest: `
+resource "workspace" "t1" {
+  workspaces = ["t1ws1"]
+}`,
+			expectedErr: "unsupported resource type",
+		},
+		{
+			name: "invalid manifest (group and workspaces at the same level)",
+			manifest: `
+resource "target" "t1" {
+  workspaces = ["t1ws1"]
+}
+resource "target" "t2" {
+  workspaces = ["t2ws1"]
+  group      = [resource.target.t1]
+}`,
+			expectedErr: "coexist at the same level",
+		},
+		{
+			name: "reference to non-existent target",
+			manifest: `
+resource "target" "t1" {
+  group = [resource.target.t2]
+}`,
+			expectedErr: "Unsupported attribute",
+		},
+		{
+			name: "circular locals",
+			manifest: `
+locals {
+  a = local.b
+  b = local.a
+}`,
+			expectedErr: "unable to resolve locals",
+		},
+		{
+			name: "for_each expands over locals",
+			manifest: `
+terrallel {
+  import = ["*.tf"]
+}
+resource "target" "network" {
+  group = values(resource.target.network-region)
+  next {
+    workspaces = ["global"]
+  }
+}`,
+			imports: map[string]string{
+				"locals.tf": `
+locals {
+  regions = ["us-east-1", "ap-southeast-2"]
+  clouds  = { aws = local.regions }
+}`,
+				"targets.tf": `
+resource "target" "network-region" {
+  for_each   = toset(local.clouds.aws)
+  workspaces = ["aws/${each.key}/network"]
+}`,
+			},
+			expected: map[string]*terrallel.Target{
+				"network": {
+					Name: "network",
+					Group: []*terrallel.Target{
+						{
+							Name:       "network-region[ap-southeast-2]",
+							Workspaces: []terrallel.Workspace{{Path: "aws/ap-southeast-2/network"}},
+						},
+						{
+							Name:       "network-region[us-east-1]",
+							Workspaces: []terrallel.Workspace{{Path: "aws/us-east-1/network"}},
+						},
+					},
+					Next: &terrallel.Target{
+						Name:       "next",
+						Workspaces: []terrallel.Workspace{{Path: "global"}},
+					},
+				},
+				"network-region[ap-southeast-2]": {
+					Name:       "network-region[ap-southeast-2]",
+					Workspaces: []terrallel.Workspace{{Path: "aws/ap-southeast-2/network"}},
+				},
+				"network-region[us-east-1]": {
+					Name:       "network-region[us-east-1]",
+					Workspaces: []terrallel.Workspace{{Path: "aws/us-east-1/network"}},
+				},
+			},
+		},
+		{
+			name: "for_each over a map exposes each.value",
+			manifest: `
+resource "target" "cluster" {
+  for_each   = { us = "us-east-1" }
+  workspaces = ["${each.value}/k8s"]
+}`,
+			expected: map[string]*terrallel.Target{
+				"cluster[us]": {
+					Name:       "cluster[us]",
+					Workspaces: []terrallel.Workspace{{Path: "us-east-1/k8s"}},
+				},
+			},
+		},
+		{
+			name: "group referencing a for_each target includes every instance",
+			manifest: `
+resource "target" "all" {
+  group = [resource.target.cluster]
+}
+resource "target" "cluster" {
+  for_each   = toset(["a"])
+  workspaces = ["${each.key}/k8s"]
+}`,
+			expected: map[string]*terrallel.Target{
+				"all": {
+					Name: "all",
+					Group: []*terrallel.Target{
+						{
+							Name:       "cluster[a]",
+							Workspaces: []terrallel.Workspace{{Path: "a/k8s"}},
+						},
+					},
+				},
+				"cluster[a]": {
+					Name:       "cluster[a]",
+					Workspaces: []terrallel.Workspace{{Path: "a/k8s"}},
+				},
+			},
+		},
+		{
+			name: "workspaces as objects with labels",
+			manifest: `
+resource "target" "t1" {
+  labels = { provider = "aws" }
+  workspaces = [
+    "t1ws1",
+    { path = "t1ws2", labels = { account = "prod" } },
+  ]
+}`,
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name:   "t1",
+					Labels: map[string]string{"provider": "aws"},
+					Workspaces: []terrallel.Workspace{
+						{Path: "t1ws1"},
+						{Path: "t1ws2", Labels: map[string]string{"account": "prod"}},
+					},
+				},
+			},
+		},
+		{
+			name: "environment and terraform workspace on targets",
+			manifest: `
+resource "target" "t1" {
+  env = { AWS_PROFILE = "dev" }
+  workspaces = [
+    { path = "t1ws1", env = { TF_VAR_region = "us-east-1" } },
+  ]
+  next {
+    env                 = { AWS_PROFILE = "shared" }
+    terraform_workspace = "stage"
+    workspaces          = ["t1ws2"]
+  }
+}`,
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name: "t1",
+					Env:  map[string]string{"AWS_PROFILE": "dev"},
+					Workspaces: []terrallel.Workspace{
+						{Path: "t1ws1", Env: map[string]string{"TF_VAR_region": "us-east-1"}},
+					},
+					Next: &terrallel.Target{
+						Name:               "next",
+						Env:                map[string]string{"AWS_PROFILE": "shared"},
+						Workspaces:         []terrallel.Workspace{{Path: "t1ws2"}},
+						TerraformWorkspace: "stage",
+					},
+				},
+			},
+		},
+		{
+			name: "workspace with retry settings",
+			manifest: `
+terrallel {
+  retry = { attempts = 1 }
+}
+resource "target" "t1" {
+  workspaces = [
+    { path = "t1ws1", retry = { attempts = 3, backoff = "10s", match = ["RequestLimitExceeded"] } },
+  ]
+}`,
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name: "t1",
+					Workspaces: []terrallel.Workspace{
+						{Path: "t1ws1", Retry: &terrallel.Retry{
+							Attempts: 3,
+							Backoff:  10 * time.Second,
+							Match:    []string{"RequestLimitExceeded"},
+						}},
+					},
+				},
+			},
+		},
+		{
+			name: "duplicate target in imports",
+			manifest: `
+terrallel {
+  import = ["*.hcl"]
+}`,
+			imports: map[string]string{
+				"1.hcl": `
+resource "target" "t2" {
+  workspaces = ["t2ws1"]
+}`,
+				"2.hcl": `
+resource "target" "t2" {
+  workspaces = ["t2ws1"]
+}`,
+			},
+			expectedErr: "duplicate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			manifestPath := filepath.Join(tempDir, "Infrafile.hcl")
+			if tt.manifest != "" {
+				if err := os.WriteFile(manifestPath, []byte(tt.manifest), 0644); err != nil {
+					t.Fatalf("failed to write main manifest: %v", err)
+				}
+			}
+			for filename, content := range tt.imports {
+				err := os.WriteFile(filepath.Join(tempDir, filename), []byte(content), 0644)
+				if err != nil {
+					t.Fatalf("failed to write import file %s: %v", filename, err)
+				}
+			}
+			infra, err := terrallel.New(manifestPath)
+			if tt.expectedErr != "" {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				} else if !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Errorf("expected error to contain %s but got error: %v", tt.expectedErr, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unxpected error: %v", err)
+				}
+				if diff := cmp.Diff(tt.expected, infra.Manifest); diff != "" {
+					t.Errorf("manifest mismatch (-expected +actual):\n%s", diff)
+				}
+			}
+		})
+	}
+}
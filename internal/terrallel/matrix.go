@@ -0,0 +1,210 @@
+package terrallel
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var placeholder = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// matrix describes the combinations a target should be generated for. Every
+// named list is an axis and the cartesian product of all axes is generated.
+// Entries under include are added as-is after the product.
+type matrix struct {
+	Axes    map[string][]string `yaml:",inline"`
+	Include []map[string]string `yaml:"include,omitempty"`
+}
+
+func (m *matrix) combinations() []map[string]string {
+	var keys []string
+	for key := range m.Axes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var combos []map[string]string
+	if len(keys) != 0 {
+		combos = []map[string]string{{}}
+	}
+	for _, key := range keys {
+		var next []map[string]string
+		for _, combo := range combos {
+			for _, value := range m.Axes[key] {
+				extended := map[string]string{key: value}
+				for k, v := range combo {
+					extended[k] = v
+				}
+				next = append(next, extended)
+			}
+		}
+		combos = next
+	}
+	return append(combos, m.Include...)
+}
+
+// expand returns the targets generated by a matrix. Targets without a matrix
+// are returned unchanged. When the name of a matrix target has no
+// placeholders, each generated target is named by appending the values of the
+// combination and the original name becomes a group of all of them.
+func (t *target) expand(name string) (map[string]*target, error) {
+	if t.Matrix == nil {
+		return map[string]*target{name: t}, nil
+	}
+	for next := t.Next; next != nil; next = next.Next {
+		if next.Matrix != nil {
+			return nil, fmt.Errorf("target %s: matrix is only allowed at the top level of a target", name)
+		}
+	}
+	combos := t.Matrix.combinations()
+	if len(combos) == 0 {
+		return nil, fmt.Errorf("target %s: matrix has no combinations", name)
+	}
+	templated := placeholder.MatchString(name)
+	expanded := map[string]*target{}
+	var names []string
+	for _, vars := range combos {
+		instanceName, err := substitute(name, vars)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", name, err)
+		}
+		if !templated {
+			instanceName = matrixName(name, vars)
+		}
+		if _, exists := expanded[instanceName]; exists {
+			return nil, fmt.Errorf("duplicate: %s", instanceName)
+		}
+		instance, err := t.substitute(vars)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", instanceName, err)
+		}
+		expanded[instanceName] = instance
+		names = append(names, instanceName)
+	}
+	if !templated {
+		expanded[name] = &target{Group: names}
+	}
+	return expanded, nil
+}
+
+func (t *target) substitute(vars map[string]string) (*target, error) {
+	out := &target{
+		parent: t.parent,
+	}
+	labels, err := substituteMap(t.Labels, vars)
+	if err != nil {
+		return nil, err
+	}
+	out.Labels = labels
+	if out.Env, err = substituteMap(t.Env, vars); err != nil {
+		return nil, err
+	}
+	if out.TerraformWorkspace, err = substitute(t.TerraformWorkspace, vars); err != nil {
+		return nil, err
+	}
+	for _, ws := range t.Workspaces {
+		value, err := substitute(ws.Path, vars)
+		if err != nil {
+			return nil, err
+		}
+		labels, err := substituteMap(ws.Labels, vars)
+		if err != nil {
+			return nil, err
+		}
+		ws.Path = value
+		ws.Labels = labels
+		if ws.Vars, err = substituteMap(ws.Vars, vars); err != nil {
+			return nil, err
+		}
+		if ws.Env, err = substituteMap(ws.Env, vars); err != nil {
+			return nil, err
+		}
+		if ws.TerraformWorkspace, err = substitute(ws.TerraformWorkspace, vars); err != nil {
+			return nil, err
+		}
+		if ws.VarFiles, err = substituteAll(ws.VarFiles, vars); err != nil {
+			return nil, err
+		}
+		if ws.Args != nil {
+			args := map[string][]string{}
+			for command, values := range ws.Args {
+				if args[command], err = substituteAll(values, vars); err != nil {
+					return nil, err
+				}
+			}
+			ws.Args = args
+		}
+		out.Workspaces = append(out.Workspaces, ws)
+	}
+	for _, group := range t.Group {
+		value, err := substitute(group, vars)
+		if err != nil {
+			return nil, err
+		}
+		out.Group = append(out.Group, value)
+	}
+	if t.Next != nil {
+		next, err := t.Next.substitute(vars)
+		if err != nil {
+			return nil, err
+		}
+		out.Next = next
+	}
+	return out, nil
+}
+
+func substitute(value string, vars map[string]string) (string, error) {
+	var err error
+	result := placeholder.ReplaceAllStringFunc(value, func(match string) string {
+		key := placeholder.FindStringSubmatch(match)[1]
+		if v, ok := vars[key]; ok {
+			return v
+		}
+		err = fmt.Errorf("unknown matrix key %q in %s", key, value)
+		return match
+	})
+	return result, err
+}
+
+func substituteAll(values []string, vars map[string]string) ([]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		value, err := substitute(v, vars)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = value
+	}
+	return out, nil
+}
+
+func substituteMap(labels map[string]string, vars map[string]string) (map[string]string, error) {
+	if labels == nil {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for k, v := range labels {
+		value, err := substitute(v, vars)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = value
+	}
+	return out, nil
+}
+
+func matrixName(name string, vars map[string]string) string {
+	var keys []string
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{name}
+	for _, key := range keys {
+		parts = append(parts, vars[key])
+	}
+	return strings.Join(parts, "-")
+}
@@ -2,12 +2,13 @@ package terrallel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
+	"time"
 
 	"github.com/tkellen/treeprint"
 )
@@ -18,27 +19,91 @@ type Job interface {
 	Result() string
 }
 
+// Queuer is implemented by jobs which want to be told when they are ready to
+// run but are held back by a concurrency limit.
+type Queuer interface {
+	Queued(reason string)
+}
+
+// Skipper is implemented by jobs which want to record why they were not run.
+type Skipper interface {
+	Skip(reason string)
+}
+
+// Aborter is implemented by jobs which can record that they were cancelled
+// because of a failure elsewhere rather than by the user.
+type Aborter interface {
+	Abort(reason string) error
+}
+
+// Excluder is implemented by jobs which want to record that they were left
+// out of a run on purpose.
+type Excluder interface {
+	Exclude()
+}
+
+// Options controls how a tree is run.
+type Options struct {
+	// Reverse runs the tree in teardown order.
+	Reverse bool
+	// DryRun asks every job to report what it would do instead of doing it.
+	DryRun bool
+	// Parallelism caps the number of jobs running at once. Zero is unlimited.
+	Parallelism int
+	// Pools caps the number of jobs running at once per label value, keyed by
+	// label name and then value.
+	Pools map[string]map[string]int
+	// KeepGoing continues running every job which does not depend on a
+	// failure instead of starting nothing new after the first one.
+	KeepGoing bool
+	// FailFast interrupts every running job as soon as any job fails.
+	FailFast bool
+	// Timeout stops the whole run when it takes longer than this. Jobs still
+	// running are aborted as timed-out. Zero never times out.
+	Timeout time.Duration
+	// Unordered runs every job at once, ignoring the order of the tree. It
+	// is only safe for commands which change nothing.
+	Unordered bool
+	// First holds jobs which run one at a time before any other, ignoring
+	// the order of the tree. The rest start once every one of them has
+	// finished, whether or not it succeeded. It is only safe for commands
+	// such as init which do not depend on order.
+	First map[Job]bool
+	// StopWait is how long a job stopped by a timeout, a failure elsewhere or
+	// cancellation is given to exit before the run stops waiting for it. Zero
+	// doesn't wait at all.
+	StopWait time.Duration
+	// Exclude holds jobs which are not run. Jobs depending on them still wait
+	// for what they depend on so the order of the rest is unchanged.
+	Exclude map[Job]bool
+}
+
 type Tree struct {
-	Name  string
-	Jobs  []Job
-	Group []*Tree
-	Next  *Tree
+	Name string
+	Jobs []Job
+	// Labels holds the manifest labels of the job at the same index in Jobs.
+	Labels []map[string]string
+	Group  []*Tree
+	Next   *Tree
 }
 
 func (t *Tree) String() string {
 	return t.Report(treeprint.NewWithRoot(t.Name)).String()
 }
 
-func (t *Tree) Cancel() error {
-	return nil
-}
-
-func (t *Tree) Do(reverse bool, dryrun bool) error {
+func (t *Tree) Do(opts Options) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	termReceived := false
 	termMessage := false
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	// the handler goes with the run so a later run in the same process is
+	// the only one to answer signals.
+	defer func() {
+		signal.Stop(sigChan)
+		close(sigChan)
+		cancel()
+	}()
 	go func() {
 		for range sigChan {
 			if termReceived {
@@ -53,115 +118,154 @@ func (t *Tree) Do(reverse bool, dryrun bool) error {
 			cancel()
 		}
 	}()
-	var err error
-	if reverse {
-		err = t.Reverse(ctx, dryrun)
-	} else {
-		err = t.Forward(ctx, dryrun)
-	}
-	if err != nil {
+	if err := t.Run(ctx, opts); err != nil {
 		return fmt.Errorf("some jobs failed to complete.\n%s", err)
 	}
 	return nil
 }
 
-func (t *Tree) Forward(ctx context.Context, dryrun bool) error {
-	if err := parallel(ctx, t.Group, func(child *Tree) error {
-		return child.Forward(ctx, dryrun)
-	}); err != nil {
-		return err
+func (t *Tree) Run(ctx context.Context, opts Options) error {
+	g := t.compile(opts.Reverse)
+	if opts.Unordered {
+		for _, n := range g.nodes {
+			n.deps = nil
+		}
 	}
-	if err := parallel(ctx, t.Jobs, func(j Job) error {
-		return j.Run(dryrun)
-	}); err != nil {
-		return err
+	if len(opts.First) != 0 {
+		g.first(opts.First)
 	}
-	if t.Next != nil {
-		return t.Next.Forward(ctx, dryrun)
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
-	return nil
+	err := g.run(ctx, opts)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Join(fmt.Errorf("run timed out after %s", opts.Timeout), err)
+	}
+	return err
+}
+
+func (t *Tree) Forward(ctx context.Context, dryrun bool) error {
+	return t.Run(ctx, Options{DryRun: dryrun})
 }
 
 func (t *Tree) Reverse(ctx context.Context, dryrun bool) error {
-	if t.Next != nil {
-		if err := t.Next.Reverse(ctx, dryrun); err != nil {
-			return err
-		}
-	}
-	if err := parallel(ctx, t.Jobs, func(j Job) error {
-		return j.Run(dryrun)
-	}); err != nil {
-		return err
-	}
-	if err := parallel(ctx, t.Group, func(child *Tree) error {
-		return child.Reverse(ctx, dryrun)
-	}); err != nil {
-		return err
-	}
-	return nil
+	return t.Run(ctx, Options{Reverse: true, DryRun: dryrun})
 }
 
 func (t *Tree) Report(root treeprint.Tree) treeprint.Tree {
+	return t.report(root, t.placements(t.Name, map[Job][]string{}), t.Name)
+}
+
+func (t *Tree) report(root treeprint.Tree, placed map[Job][]string, path string) treeprint.Tree {
 	if len(t.Group) != 0 {
 		groups := root.AddBranch("groups")
 		for _, g := range t.Group {
-			g.Report(groups.AddBranch(g.Name))
+			g.report(groups.AddBranch(g.Name), placed, targetPath(path, g.Name))
 		}
 	}
 	if len(t.Jobs) != 0 {
 		workspaces := root.AddBranch("workspaces")
 		for _, ws := range t.Jobs {
-			workspaces.AddNode(ws.Result())
+			result := ws.Result()
+			var others []string
+			for _, other := range placed[ws] {
+				if other != path {
+					others = append(others, other)
+				}
+			}
+			if len(others) != 0 {
+				result = fmt.Sprintf("%s (shared with %s)", result, strings.Join(others, ", "))
+			}
+			workspaces.AddNode(result)
 		}
 	}
 	if t.Next != nil {
-		t.Next.Report(root.AddBranch("next"))
+		t.Next.report(root.AddBranch("next"), placed, path)
 	}
 	return root
 }
 
-type Cancellable interface {
-	Cancel() error
+// placements records the path of targets leading to every position a job
+// appears in so shared jobs can be identified in the report.
+func (t *Tree) placements(path string, placed map[Job][]string) map[Job][]string {
+	for _, job := range t.Jobs {
+		placed[job] = append(placed[job], path)
+	}
+	for _, g := range t.Group {
+		g.placements(targetPath(path, g.Name), placed)
+	}
+	if t.Next != nil {
+		t.Next.placements(path, placed)
+	}
+	return placed
 }
 
-func parallel[T Cancellable](ctx context.Context, items []T, run func(T) error) error {
-	if len(items) == 0 {
-		return nil
+// Find returns every job beneath the targets in the tree with the given name.
+func (t *Tree) Find(name string) []Job {
+	if t.Name == name {
+		return t.all()
 	}
-	wg := &sync.WaitGroup{}
-	errCh := make(chan error, len(items))
-	for _, item := range items {
-		wg.Add(1)
-		go func(item T) {
-			defer wg.Done()
-			runCh := make(chan error, 1)
-			go func() {
-				runCh <- run(item)
-			}()
-			select {
-			case <-ctx.Done():
-				errCh <- item.Cancel()
-			case err := <-runCh:
-				errCh <- err
-			}
-		}(item)
+	var found []Job
+	for _, g := range t.Group {
+		found = append(found, g.Find(name)...)
 	}
-	go func() {
-		wg.Wait()
-		close(errCh)
-	}()
-	var errs []error
-	for err := range errCh {
-		if err != nil {
-			errs = append(errs, err)
+	if t.Next != nil {
+		found = append(found, t.Next.Find(name)...)
+	}
+	return found
+}
+
+func (t *Tree) all() []Job {
+	jobs := append([]Job{}, t.Jobs...)
+	for _, g := range t.Group {
+		jobs = append(jobs, g.all()...)
+	}
+	if t.Next != nil {
+		jobs = append(jobs, t.Next.all()...)
+	}
+	return jobs
+}
+
+// Prune returns a copy of the tree holding only the jobs to keep. Levels
+// left without jobs are dropped, so what remains runs in the same order
+// relative to each other as in the full tree.
+func (t *Tree) Prune(keep map[Job]bool) *Tree {
+	pruned := t.prune(keep)
+	if pruned == nil {
+		return &Tree{Name: t.Name}
+	}
+	return pruned
+}
+
+func (t *Tree) prune(keep map[Job]bool) *Tree {
+	pruned := &Tree{Name: t.Name}
+	for i, job := range t.Jobs {
+		if keep[job] {
+			pruned.Jobs = append(pruned.Jobs, job)
+			if i < len(t.Labels) {
+				pruned.Labels = append(pruned.Labels, t.Labels[i])
+			}
 		}
 	}
-	if len(errs) != 0 {
-		errOut := make([]string, len(errs))
-		for i, err := range errs {
-			errOut[i] += err.Error()
+	for _, g := range t.Group {
+		if child := g.prune(keep); child != nil {
+			pruned.Group = append(pruned.Group, child)
 		}
-		return fmt.Errorf("%s", strings.Join(errOut, "\n"))
 	}
-	return nil
+	if t.Next != nil {
+		pruned.Next = t.Next.prune(keep)
+	}
+	if len(pruned.Jobs) == 0 && len(pruned.Group) == 0 && pruned.Next == nil {
+		return nil
+	}
+	return pruned
+}
+
+func targetPath(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + " > " + name
 }
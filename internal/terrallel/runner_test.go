@@ -1,14 +1,21 @@
 package terrallel_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/scaleoutllc/terrallel/internal/terraform"
 	"github.com/scaleoutllc/terrallel/internal/terrallel"
 	"gopkg.in/yaml.v3"
 )
@@ -454,6 +461,746 @@ func TestTreeCancel(t *testing.T) {
 	}
 }
 
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) index(event string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+type loggedJob struct {
+	name    string
+	runtime int
+	log     *eventLog
+}
+
+func (j *loggedJob) Run(dryrun bool) error {
+	j.log.add("start " + j.name)
+	time.Sleep(time.Duration(j.runtime) * time.Millisecond)
+	j.log.add("end " + j.name)
+	return nil
+}
+
+func (j *loggedJob) Queued(reason string) { j.log.add("queued " + j.name) }
+func (j *loggedJob) Cancel() error        { return nil }
+func (j *loggedJob) Result() string       { return j.name }
+
+func TestTreeSchedulesByDependency(t *testing.T) {
+	tests := []struct {
+		name    string
+		reverse bool
+		order   [][2]string
+	}{
+		{
+			name: "forward starts dependents without waiting on unrelated branches",
+			order: [][2]string{
+				{"end fast", "start probe"},
+				{"start probe", "end slow"},
+				{"end slow", "start last"},
+			},
+		},
+		{
+			name:    "reverse starts dependents without waiting on unrelated branches",
+			reverse: true,
+			order: [][2]string{
+				{"end probe", "start fast"},
+				{"start fast", "end slow"},
+				{"end slow", "start first"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &eventLog{}
+			runner := &terrallel.Tree{
+				Jobs: []terrallel.Job{&loggedJob{name: "first", runtime: 5, log: log}},
+				Next: &terrallel.Tree{
+					Group: []*terrallel.Tree{
+						{
+							Jobs: []terrallel.Job{&loggedJob{name: "slow", runtime: 150, log: log}},
+						},
+						{
+							Jobs: []terrallel.Job{&loggedJob{name: "fast", runtime: 5, log: log}},
+							Next: &terrallel.Tree{
+								Jobs: []terrallel.Job{&loggedJob{name: "probe", runtime: 5, log: log}},
+							},
+						},
+					},
+					Next: &terrallel.Tree{
+						Jobs: []terrallel.Job{&loggedJob{name: "last", runtime: 5, log: log}},
+					},
+				},
+			}
+			var err error
+			if tt.reverse {
+				err = runner.Reverse(context.Background(), false)
+			} else {
+				err = runner.Forward(context.Background(), false)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, pair := range tt.order {
+				if log.index(pair[0]) > log.index(pair[1]) {
+					t.Errorf("expected %q before %q, got %v", pair[0], pair[1], log.events)
+				}
+			}
+		})
+	}
+}
+
+func TestTreeSharedJobs(t *testing.T) {
+	log := &eventLog{}
+	shared := &loggedJob{name: "shared", runtime: 20, log: log}
+	runner := &terrallel.Tree{
+		Name: "dev",
+		Group: []*terrallel.Tree{
+			{
+				Name: "aws",
+				Jobs: []terrallel.Job{shared},
+				Next: &terrallel.Tree{
+					Jobs: []terrallel.Job{&loggedJob{name: "aws-cluster", runtime: 5, log: log}},
+				},
+			},
+			{
+				Name: "gcp",
+				Jobs: []terrallel.Job{&loggedJob{name: "gcp-network", runtime: 40, log: log}, shared},
+				Next: &terrallel.Tree{
+					Jobs: []terrallel.Job{&loggedJob{name: "gcp-cluster", runtime: 5, log: log}},
+				},
+			},
+		},
+	}
+	if err := runner.Forward(context.Background(), false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	starts := 0
+	for _, event := range log.events {
+		if event == "start shared" {
+			starts++
+		}
+	}
+	if starts != 1 {
+		t.Errorf("expected shared job to run once, ran %d times", starts)
+	}
+	if log.index("end shared") > log.index("start aws-cluster") {
+		t.Errorf("expected dependents to wait on the shared job, got %v", log.events)
+	}
+	expected := `dev
+└─ groups
+  ├─ aws
+  │ ├─ workspaces
+  │ │ └─ shared (shared with dev > gcp)
+  │ └─ next
+  │   └─ workspaces
+  │     └─ aws-cluster
+  └─ gcp
+    ├─ workspaces
+    │ ├─ gcp-network
+    │ └─ shared (shared with dev > aws)
+    └─ next
+      └─ workspaces
+        └─ gcp-cluster
+`
+	if actual := runner.String(); expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestTreeSharedJobCycle(t *testing.T) {
+	shared := &jobMock{name: "shared"}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{shared},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{&jobMock{name: "middle"}},
+			Next: &terrallel.Tree{
+				Jobs: []terrallel.Job{shared},
+			},
+		},
+	}
+	err := runner.Forward(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Errorf("expected dependency cycle error, got %v", err)
+	}
+}
+
+func TestTreeParallelism(t *testing.T) {
+	log := &eventLog{}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{
+			&loggedJob{name: "a", runtime: 20, log: log},
+			&loggedJob{name: "b", runtime: 20, log: log},
+			&loggedJob{name: "c", runtime: 20, log: log},
+		},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{
+				&loggedJob{name: "d", runtime: 20, log: log},
+				&loggedJob{name: "e", runtime: 20, log: log},
+			},
+		},
+	}
+	if err := runner.Run(context.Background(), terrallel.Options{Parallelism: 2}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	running, peak, queued := 0, 0, 0
+	for _, event := range log.events {
+		switch strings.Fields(event)[0] {
+		case "start":
+			running++
+			peak = max(peak, running)
+		case "end":
+			running--
+		case "queued":
+			queued++
+		}
+	}
+	if peak != 2 {
+		t.Errorf("expected at most 2 jobs running at once, got %d", peak)
+	}
+	if queued != 1 {
+		t.Errorf("expected 1 job to be queued, got %d: %v", queued, log.events)
+	}
+}
+
+func TestTreePools(t *testing.T) {
+	log := &eventLog{}
+	aws := map[string]string{"provider": "aws"}
+	gcp := map[string]string{"provider": "gcp"}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{
+			&loggedJob{name: "aws1", runtime: 20, log: log},
+			&loggedJob{name: "aws2", runtime: 20, log: log},
+			&loggedJob{name: "gcp1", runtime: 20, log: log},
+			&loggedJob{name: "gcp2", runtime: 20, log: log},
+		},
+		Labels: []map[string]string{aws, aws, gcp, gcp},
+	}
+	opts := terrallel.Options{
+		Pools: map[string]map[string]int{
+			"provider": {"aws": 1},
+		},
+	}
+	if err := runner.Run(context.Background(), opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	running := map[string]int{}
+	peak := map[string]int{}
+	for _, event := range log.events {
+		fields := strings.Fields(event)
+		provider := fields[1][:3]
+		switch fields[0] {
+		case "start":
+			running[provider]++
+			peak[provider] = max(peak[provider], running[provider])
+		case "end":
+			running[provider]--
+		}
+	}
+	if peak["aws"] != 1 {
+		t.Errorf("expected at most 1 aws job running at once, got %d", peak["aws"])
+	}
+	if peak["gcp"] != 2 {
+		t.Errorf("expected gcp jobs to run concurrently, got %d", peak["gcp"])
+	}
+	if log.index("queued aws1") == -1 && log.index("queued aws2") == -1 {
+		t.Errorf("expected an aws job to be queued, got %v", log.events)
+	}
+}
+
+type skippableJob struct {
+	*jobMock
+	skipped string
+}
+
+func (j *skippableJob) Skip(reason string) { j.skipped = reason }
+
+func (j *skippableJob) Result() string {
+	if j.skipped != "" {
+		return "Skipped: " + j.skipped
+	}
+	return j.jobMock.Result()
+}
+
+func TestTreeKeepGoing(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepGoing bool
+		expected  *resultTree
+	}{
+		{
+			name: "first failure stops anything new from starting",
+			expected: &resultTree{
+				Group: []*resultTree{
+					{
+						Results: []string{"Failure"},
+						Next: &resultTree{
+							Results: []string{"Skipped: dependency failed"},
+						},
+					},
+					{
+						Results: []string{"Success"},
+						Next: &resultTree{
+							Results: []string{"DidNotRun"},
+						},
+					},
+				},
+				Next: &resultTree{
+					Results: []string{"Skipped: dependency failed"},
+				},
+			},
+		},
+		{
+			name:      "keep going runs every branch not depending on the failure",
+			keepGoing: true,
+			expected: &resultTree{
+				Group: []*resultTree{
+					{
+						Results: []string{"Failure"},
+						Next: &resultTree{
+							Results: []string{"Skipped: dependency failed"},
+						},
+					},
+					{
+						Results: []string{"Success"},
+						Next: &resultTree{
+							Results: []string{"Success"},
+						},
+					},
+				},
+				Next: &resultTree{
+					Results: []string{"Skipped: dependency failed"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &terrallel.Tree{
+				Group: []*terrallel.Tree{
+					{
+						Jobs: []terrallel.Job{
+							&skippableJob{jobMock: &jobMock{runtime: 10, errWhenRun: true}},
+						},
+						Next: &terrallel.Tree{
+							Jobs: []terrallel.Job{
+								&skippableJob{jobMock: &jobMock{runtime: 10}},
+							},
+						},
+					},
+					{
+						Jobs: []terrallel.Job{
+							&skippableJob{jobMock: &jobMock{runtime: 50}},
+						},
+						Next: &terrallel.Tree{
+							Jobs: []terrallel.Job{
+								&skippableJob{jobMock: &jobMock{runtime: 10}},
+							},
+						},
+					},
+				},
+				Next: &terrallel.Tree{
+					Jobs: []terrallel.Job{
+						&skippableJob{jobMock: &jobMock{runtime: 10}},
+					},
+				},
+			}
+			err := runner.Run(context.Background(), terrallel.Options{KeepGoing: tt.keepGoing})
+			if err == nil {
+				t.Fatalf("expected error but got none")
+			}
+			got := collectResults(runner)
+			if diff := cmp.Diff(tt.expected, got); diff != "" {
+				t.Fatalf("exit trees do not match, expected\n%s\n---\ngot\n%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+type abortableJob struct {
+	*jobMock
+	aborted string
+}
+
+func (j *abortableJob) Abort(reason string) error {
+	j.aborted = reason
+	return nil
+}
+
+func (j *abortableJob) Result() string {
+	if j.aborted != "" {
+		return "Aborted: " + j.aborted
+	}
+	return j.jobMock.Result()
+}
+
+func TestTreeFailFast(t *testing.T) {
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{
+			&abortableJob{jobMock: &jobMock{runtime: 10, errWhenRun: true}},
+			&abortableJob{jobMock: &jobMock{runtime: 500}},
+		},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{
+				&abortableJob{jobMock: &jobMock{runtime: 10}},
+			},
+		},
+	}
+	expected := &resultTree{
+		Results: []string{"Failure", "Aborted: cancelled due to failure elsewhere"},
+		Next: &resultTree{
+			Results: []string{"DidNotRun"},
+		},
+	}
+	start := time.Now()
+	if err := runner.Run(context.Background(), terrallel.Options{FailFast: true}); err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected running jobs to be cancelled, run took %s", elapsed)
+	}
+	got := collectResults(runner)
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Fatalf("exit trees do not match, expected\n%s\n---\ngot\n%s", expected, got)
+	}
+}
+
+func TestTreeTimeout(t *testing.T) {
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{
+			&abortableJob{jobMock: &jobMock{runtime: 10}},
+			&abortableJob{jobMock: &jobMock{runtime: 500}},
+		},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{
+				&abortableJob{jobMock: &jobMock{runtime: 10}},
+			},
+		},
+	}
+	expected := &resultTree{
+		Results: []string{"Success", "Aborted: timed-out"},
+		Next: &resultTree{
+			Results: []string{"DidNotRun"},
+		},
+	}
+	start := time.Now()
+	err := runner.Run(context.Background(), terrallel.Options{Timeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "run timed out after 100ms") {
+		t.Fatalf("expected timeout error but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected running jobs to be stopped, run took %s", elapsed)
+	}
+	got := collectResults(runner)
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Fatalf("exit trees do not match, expected\n%s\n---\ngot\n%s", expected, got)
+	}
+}
+
+func TestTreeTimeoutStopsProcesses(t *testing.T) {
+	requireShell(t)
+	var stdout, stderr bytes.Buffer
+	basedir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(basedir, "stubborn"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	job := &terraform.Job{
+		Name:    "stubborn",
+		Basedir: basedir,
+		Bin:     "sh",
+		Args:    []string{"-c", "trap '' INT; sleep 30"},
+		Grace:   100 * time.Millisecond,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	runner := &terrallel.Tree{Jobs: []terrallel.Job{job}}
+	start := time.Now()
+	err := runner.Run(context.Background(), terrallel.Options{
+		Timeout:  300 * time.Millisecond,
+		StopWait: time.Second,
+	})
+	elapsed := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "run timed out after 300ms") {
+		t.Fatalf("expected timeout error but got %v", err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected the run to wait for the job to be terminated, run took %s", elapsed)
+	}
+	record := job.Record()
+	if record.Status != "timed-out" || record.Finished.IsZero() {
+		t.Errorf("expected the job to have finished as timed-out, got %s finished at %s", record.Status, record.Finished)
+	}
+}
+
+type excludableJob struct {
+	*jobMock
+	excluded bool
+}
+
+func (j *excludableJob) Exclude() { j.excluded = true }
+
+func (j *excludableJob) Result() string {
+	if j.excluded {
+		return "Excluded"
+	}
+	return j.jobMock.Result()
+}
+
+func TestTreeExclude(t *testing.T) {
+	log := &eventLog{}
+	first := &loggedJob{name: "first", runtime: 10, log: log}
+	excluded := &excludableJob{jobMock: &jobMock{runtime: 10}}
+	last := &loggedJob{name: "last", runtime: 10, log: log}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{first},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{excluded},
+			Next: &terrallel.Tree{Jobs: []terrallel.Job{last}},
+		},
+	}
+	opts := terrallel.Options{Exclude: map[terrallel.Job]bool{excluded: true}}
+	if err := runner.Run(context.Background(), opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if excluded.Result() != "Excluded" {
+		t.Errorf("expected excluded job to be reported, got %s", excluded.Result())
+	}
+	if log.index("end first") > log.index("start last") {
+		t.Errorf("expected jobs after an excluded job to keep their order, got %v", log.events)
+	}
+}
+
+func TestTreeUnordered(t *testing.T) {
+	log := &eventLog{}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{&loggedJob{name: "first", runtime: 50, log: log}},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{&loggedJob{name: "second", runtime: 50, log: log}},
+		},
+	}
+	if err := runner.Run(context.Background(), terrallel.Options{Unordered: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if log.index("start second") > log.index("end first") {
+		t.Errorf("expected jobs to run at once, got %v", log.events)
+	}
+}
+
+func TestTreeFirst(t *testing.T) {
+	log := &eventLog{}
+	first := &loggedJob{name: "first", runtime: 20, log: log}
+	warm := &loggedJob{name: "warm", runtime: 20, log: log}
+	other := &loggedJob{name: "other", runtime: 20, log: log}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{first},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{warm, other, &loggedJob{name: "sibling", runtime: 20, log: log}},
+		},
+	}
+	opts := terrallel.Options{First: map[terrallel.Job]bool{warm: true, other: true}}
+	if err := runner.Run(context.Background(), opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if log.index("end warm") > log.index("start first") || log.index("end other") > log.index("start first") {
+		t.Errorf("expected the first jobs to run before any other, got %v", log.events)
+	}
+	if log.index("end warm") > log.index("start other") {
+		t.Errorf("expected the first jobs to run one at a time, got %v", log.events)
+	}
+	if log.index("end first") > log.index("start sibling") {
+		t.Errorf("expected the rest to keep their order, got %v", log.events)
+	}
+}
+
+func TestTreeFirstFailure(t *testing.T) {
+	warm := &jobMock{runtime: 10, errWhenRun: true}
+	runner := &terrallel.Tree{
+		Jobs: []terrallel.Job{warm, &jobMock{runtime: 10}},
+	}
+	expected := &resultTree{
+		Results: []string{"Failure", "Success"},
+	}
+	opts := terrallel.Options{KeepGoing: true, First: map[terrallel.Job]bool{warm: true}}
+	if err := runner.Run(context.Background(), opts); err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	got := collectResults(runner)
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Fatalf("exit trees do not match, expected\n%s\n---\ngot\n%s", expected, got)
+	}
+}
+
+func TestTreeDependents(t *testing.T) {
+	network := &namedJob{name: "network"}
+	dns := &namedJob{name: "dns"}
+	cluster := &namedJob{name: "cluster"}
+	app := &namedJob{name: "app"}
+	runner := &terrallel.Tree{
+		Group: []*terrallel.Tree{
+			{
+				Jobs: []terrallel.Job{network},
+				Next: &terrallel.Tree{Jobs: []terrallel.Job{cluster}},
+			},
+			{Jobs: []terrallel.Job{dns}},
+		},
+		Next: &terrallel.Tree{Jobs: []terrallel.Job{app}},
+	}
+	tests := []struct {
+		name     string
+		reverse  bool
+		jobs     []terrallel.Job
+		expected []string
+	}{
+		{
+			name:     "forward",
+			jobs:     []terrallel.Job{network},
+			expected: []string{"app", "cluster", "network"},
+		},
+		{
+			name:     "reverse",
+			reverse:  true,
+			jobs:     []terrallel.Job{cluster},
+			expected: []string{"cluster", "network"},
+		},
+		{
+			name:     "last job",
+			jobs:     []terrallel.Job{app},
+			expected: []string{"app"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for job := range runner.Dependents(test.reverse, test.jobs) {
+				got = append(got, job.Result())
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("dependents do not match (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTreeDependencies(t *testing.T) {
+	network := &namedJob{name: "network"}
+	dns := &namedJob{name: "dns"}
+	cluster := &namedJob{name: "cluster"}
+	app := &namedJob{name: "app"}
+	runner := &terrallel.Tree{
+		Group: []*terrallel.Tree{
+			{
+				Jobs: []terrallel.Job{network},
+				Next: &terrallel.Tree{Jobs: []terrallel.Job{cluster}},
+			},
+			{Jobs: []terrallel.Job{dns}},
+		},
+		Next: &terrallel.Tree{Jobs: []terrallel.Job{app}},
+	}
+	tests := []struct {
+		name     string
+		reverse  bool
+		jobs     []terrallel.Job
+		expected []string
+	}{
+		{
+			name:     "forward",
+			jobs:     []terrallel.Job{cluster},
+			expected: []string{"cluster", "network"},
+		},
+		{
+			name:     "reverse",
+			reverse:  true,
+			jobs:     []terrallel.Job{network},
+			expected: []string{"app", "cluster", "network"},
+		},
+		{
+			name:     "first job",
+			jobs:     []terrallel.Job{dns},
+			expected: []string{"dns"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for job := range runner.Dependencies(test.reverse, test.jobs) {
+				got = append(got, job.Result())
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("dependencies do not match (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTreePrune(t *testing.T) {
+	network := &namedJob{name: "network"}
+	dns := &namedJob{name: "dns"}
+	cluster := &namedJob{name: "cluster"}
+	app := &namedJob{name: "app"}
+	runner := &terrallel.Tree{
+		Name: "dev",
+		Group: []*terrallel.Tree{
+			{
+				Name: "aws",
+				Jobs: []terrallel.Job{network},
+				Next: &terrallel.Tree{Jobs: []terrallel.Job{cluster}},
+			},
+			{Name: "dns", Jobs: []terrallel.Job{dns}},
+		},
+		Next: &terrallel.Tree{Jobs: []terrallel.Job{app}},
+	}
+	if got := len(runner.Find("aws")); got != 2 {
+		t.Errorf("expected to find 2 jobs in aws, found %d", got)
+	}
+	pruned := runner.Prune(map[terrallel.Job]bool{cluster: true, app: true})
+	expected := `dev
+├─ groups
+│ └─ aws
+│   └─ next
+│     └─ workspaces
+│       └─ cluster
+└─ next
+  └─ workspaces
+    └─ app
+`
+	if got := pruned.String(); got != expected {
+		t.Errorf("expected pruned tree\n%s\ngot\n%s", expected, got)
+	}
+	log := &eventLog{}
+	first := &loggedJob{name: "first", runtime: 10, log: log}
+	last := &loggedJob{name: "last", runtime: 10, log: log}
+	ordered := &terrallel.Tree{
+		Jobs: []terrallel.Job{first},
+		Next: &terrallel.Tree{
+			Jobs: []terrallel.Job{&namedJob{name: "middle"}},
+			Next: &terrallel.Tree{Jobs: []terrallel.Job{last}},
+		},
+	}
+	err := ordered.Prune(map[terrallel.Job]bool{first: true, last: true}).Forward(context.Background(), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if log.index("end first") > log.index("start last") {
+		t.Errorf("expected pruned tree to keep its order, got %v", log.events)
+	}
+}
+
 func TestTreeReport(t *testing.T) {
 	runner := &terrallel.Tree{
 		Group: []*terrallel.Tree{
@@ -516,3 +1263,12 @@ func TestTreeReport(t *testing.T) {
 		t.Errorf("expected %s, got %s", expected, actual)
 	}
 }
+
+// requireShell skips tests which stand in for terraform with a POSIX shell
+// script, as windows cannot run them.
+func requireShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+}
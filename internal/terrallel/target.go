@@ -1,26 +1,174 @@
 package terrallel
 
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 type Target struct {
 	Name       string
-	Group      []*Target `yaml:"group,omitempty"`
-	Workspaces []string  `yaml:"workspaces,omitempty"`
-	Next       *Target   `yaml:"next,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+	Env        map[string]string `yaml:"env,omitempty"`
+	Group      []*Target         `yaml:"group,omitempty"`
+	Workspaces []Workspace       `yaml:"workspaces,omitempty"`
+	Next       *Target           `yaml:"next,omitempty"`
+	// TerraformWorkspace is the terraform workspace of every workspace
+	// beneath the target which doesn't name its own.
+	TerraformWorkspace string `yaml:"terraform_workspace,omitempty"`
+}
+
+// Workspace is a directory to run in along with the settings the manifest
+// attaches to it. In YAML it may be written as a plain path.
+type Workspace struct {
+	Path   string            `yaml:"path"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Binary overrides the program from the terrallel config.
+	Binary string `yaml:"binary,omitempty"`
+	// Retry overrides the retry settings from the terrallel config.
+	Retry *Retry `yaml:"retry,omitempty"`
+	// Timeout overrides the job timeout from the terrallel config.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Args holds extra terraform arguments keyed by the subcommand they are
+	// added to.
+	Args map[string][]string `yaml:"args,omitempty"`
+	// VarFiles and Vars are passed as -var-file and -var to the subcommands
+	// which accept them.
+	VarFiles []string          `yaml:"var_files,omitempty"`
+	Vars     map[string]string `yaml:"vars,omitempty"`
+	// Env is added to the environment terraform runs with.
+	Env map[string]string `yaml:"env,omitempty"`
+	// TerraformWorkspace is the terraform workspace to run in. The same path
+	// may appear more than once in a target under different ones.
+	TerraformWorkspace string `yaml:"terraform_workspace,omitempty"`
+}
+
+// Retry describes re-running jobs which fail. Backoff is the wait before the
+// first retry and doubles for each attempt after. When Match is set, only
+// failures whose stderr matches one of its regular expressions are retried.
+type Retry struct {
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff,omitempty"`
+	Match    []string      `yaml:"match,omitempty"`
+}
+
+func (w *Workspace) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&w.Path)
+	}
+	type plain Workspace
+	return node.Decode((*plain)(w))
+}
+
+// Key identifies the workspace within a run: its path, followed by its
+// terraform workspace when it has one.
+func (w Workspace) Key() string {
+	key := path.Clean(w.Path)
+	if w.TerraformWorkspace != "" {
+		key += "@" + w.TerraformWorkspace
+	}
+	return key
+}
+
+// inherit returns a copy of the workspace with the labels, environment and
+// terraform workspace of enclosing targets applied beneath its own.
+func (w Workspace) inherit(parent Workspace) Workspace {
+	w.Labels = mergeMap(parent.Labels, w.Labels)
+	w.Env = mergeMap(parent.Env, w.Env)
+	if w.TerraformWorkspace == "" {
+		w.TerraformWorkspace = parent.TerraformWorkspace
+	}
+	return w
+}
+
+func mergeMap(parent map[string]string, child map[string]string) map[string]string {
+	if len(parent) == 0 {
+		return child
+	}
+	merged := map[string]string{}
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range child {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Runner builds the tree of jobs for the target. A workspace reached through
+// more than one path in the target gets exactly one job which every position
+// in the tree shares. Labels, environment and the terraform workspace of a
+// target are inherited by every workspace beneath it through group and next.
+// It is an error for the positions of a shared workspace to end up with
+// different settings, as only one of them could be run, or to place it both
+// before and after another workspace.
+func (t *Target) Runner(fn func(Workspace) Job) (*Tree, error) {
+	type placed struct {
+		ws  Workspace
+		job Job
+	}
+	jobs := map[string]placed{}
+	var err error
+	tree := t.runner(Workspace{}, func(ws Workspace) Job {
+		key := ws.Key()
+		if first, ok := jobs[key]; ok {
+			if err == nil && !sameSettings(first.ws, ws) {
+				err = fmt.Errorf("workspace %s appears more than once with different settings", key)
+			}
+			return first.job
+		}
+		job := fn(ws)
+		jobs[key] = placed{ws: ws, job: job}
+		return job
+	})
+	if err != nil {
+		return nil, err
+	}
+	// a shared workspace placed both before and after another can never run,
+	// which is a mistake in the manifest rather than a failure of the run.
+	if n := tree.compile(false).cycle(); n != nil {
+		for key, placed := range jobs {
+			if placed.job == n.job {
+				return nil, fmt.Errorf("workspace %s depends on itself: it is placed both before and after another workspace in %s", key, t.Name)
+			}
+		}
+	}
+	return tree, nil
+}
+
+// sameSettings reports whether two placements of a workspace would run it
+// the same way.
+func sameSettings(a Workspace, b Workspace) bool {
+	a.Path = path.Clean(a.Path)
+	b.Path = path.Clean(b.Path)
+	return reflect.DeepEqual(a, b)
 }
 
-func (t *Target) Runner(fn func(string) Job) *Tree {
+func (t *Target) runner(parent Workspace, fn func(Workspace) Job) *Tree {
+	parent = Workspace{
+		Labels:             t.Labels,
+		Env:                t.Env,
+		TerraformWorkspace: t.TerraformWorkspace,
+	}.inherit(parent)
 	node := &Tree{
-		Name:  t.Name,
-		Jobs:  make([]Job, len(t.Workspaces)),
-		Group: make([]*Tree, len(t.Group)),
+		Name:   t.Name,
+		Jobs:   make([]Job, len(t.Workspaces)),
+		Labels: make([]map[string]string, len(t.Workspaces)),
+		Group:  make([]*Tree, len(t.Group)),
 	}
 	for i, ws := range t.Workspaces {
+		ws = ws.inherit(parent)
 		node.Jobs[i] = fn(ws)
+		node.Labels[i] = ws.Labels
 	}
 	for i, g := range t.Group {
-		node.Group[i] = g.Runner(fn)
+		node.Group[i] = g.runner(parent, fn)
 	}
 	if t.Next != nil {
-		node.Next = t.Next.Runner(fn)
+		node.Next = t.Next.runner(parent, fn)
 	}
 	return node
 }
@@ -1 +1,274 @@
 package terrallel_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/scaleoutllc/terrallel/internal/terrallel"
+)
+
+type namedJob struct {
+	name string
+}
+
+func (j *namedJob) Run(dryrun bool) error { return nil }
+func (j *namedJob) Cancel() error         { return nil }
+func (j *namedJob) Result() string        { return j.name }
+
+func TestTargetRunnerSharesWorkspaces(t *testing.T) {
+	network := &terrallel.Target{
+		Name:       "network",
+		Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+	}
+	target := &terrallel.Target{
+		Name: "dev",
+		Group: []*terrallel.Target{
+			{
+				Name:  "aws",
+				Group: []*terrallel.Target{network},
+				Next: &terrallel.Target{
+					Name:       "next",
+					Workspaces: []terrallel.Workspace{{Path: "aws/cluster"}},
+				},
+			},
+			{
+				Name:  "gcp",
+				Group: []*terrallel.Target{network},
+				Next: &terrallel.Target{
+					Name:       "next",
+					Workspaces: []terrallel.Workspace{{Path: "gcp/cluster"}},
+				},
+			},
+			{
+				Name:       "dns",
+				Workspaces: []terrallel.Workspace{{Path: "shared/network/"}},
+			},
+		},
+	}
+	created := map[string]int{}
+	runner, err := target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+		created[ws.Path]++
+		return &namedJob{name: ws.Path}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created["shared/network"] != 1 || len(created) != 3 {
+		t.Fatalf("expected one job per workspace, got %v", created)
+	}
+	aws := runner.Group[0].Group[0].Jobs[0]
+	gcp := runner.Group[1].Group[0].Jobs[0]
+	trailing := runner.Group[2].Jobs[0]
+	if aws != gcp || aws != trailing {
+		t.Errorf("expected shared workspace to use the same job in every position")
+	}
+}
+
+func TestTargetRunnerInheritsLabels(t *testing.T) {
+	target := &terrallel.Target{
+		Name:   "dev",
+		Labels: map[string]string{"account": "dev", "provider": "aws"},
+		Group: []*terrallel.Target{
+			{
+				Name:   "gcp",
+				Labels: map[string]string{"provider": "gcp"},
+				Workspaces: []terrallel.Workspace{
+					{Path: "gcp/network"},
+					{Path: "gcp/global", Labels: map[string]string{"account": "shared"}},
+				},
+			},
+		},
+		Next: &terrallel.Target{
+			Name:       "next",
+			Workspaces: []terrallel.Workspace{{Path: "aws/network"}},
+		},
+	}
+	labels := map[string]map[string]string{}
+	runner, err := target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+		labels[ws.Path] = ws.Labels
+		return &namedJob{name: ws.Path}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"gcp/network": {"account": "dev", "provider": "gcp"},
+		"gcp/global":  {"account": "shared", "provider": "gcp"},
+		"aws/network": {"account": "dev", "provider": "aws"},
+	}
+	if diff := cmp.Diff(expected, labels); diff != "" {
+		t.Errorf("labels mismatch (-expected +actual):\n%s", diff)
+	}
+	if diff := cmp.Diff(expected["gcp/global"], runner.Group[0].Labels[1]); diff != "" {
+		t.Errorf("tree labels mismatch (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestTargetRunnerInheritsEnv(t *testing.T) {
+	target := &terrallel.Target{
+		Name: "dev",
+		Env:  map[string]string{"AWS_PROFILE": "dev", "TF_VAR_region": "us-east-1"},
+		Group: []*terrallel.Target{
+			{
+				Name: "eu",
+				Env:  map[string]string{"TF_VAR_region": "eu-west-1"},
+				Workspaces: []terrallel.Workspace{
+					{Path: "aws/eu-west-1/network"},
+					{Path: "aws/global", Env: map[string]string{"AWS_PROFILE": "shared"}},
+				},
+			},
+		},
+		Next: &terrallel.Target{
+			Name:       "next",
+			Workspaces: []terrallel.Workspace{{Path: "aws/us-east-1/network"}},
+		},
+	}
+	env := map[string]map[string]string{}
+	if _, err := target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+		env[ws.Path] = ws.Env
+		return &namedJob{name: ws.Path}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"aws/eu-west-1/network": {"AWS_PROFILE": "dev", "TF_VAR_region": "eu-west-1"},
+		"aws/global":            {"AWS_PROFILE": "shared", "TF_VAR_region": "eu-west-1"},
+		"aws/us-east-1/network": {"AWS_PROFILE": "dev", "TF_VAR_region": "us-east-1"},
+	}
+	if diff := cmp.Diff(expected, env); diff != "" {
+		t.Errorf("env mismatch (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestTargetRunnerTerraformWorkspaces(t *testing.T) {
+	target := &terrallel.Target{
+		Name:               "dev",
+		TerraformWorkspace: "dev",
+		Group: []*terrallel.Target{
+			{
+				Name: "networks",
+				Workspaces: []terrallel.Workspace{
+					{Path: "network"},
+					{Path: "network", TerraformWorkspace: "stage"},
+				},
+			},
+			{
+				Name:       "shared",
+				Workspaces: []terrallel.Workspace{{Path: "network/"}},
+			},
+		},
+	}
+	var keys []string
+	runner, err := target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+		keys = append(keys, ws.Key())
+		return &namedJob{name: ws.Key()}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"network@dev", "network@stage"}, keys); diff != "" {
+		t.Errorf("keys mismatch (-expected +actual):\n%s", diff)
+	}
+	networks := runner.Group[0].Jobs
+	if networks[0] == networks[1] {
+		t.Errorf("expected one job per terraform workspace")
+	}
+	if networks[0] != runner.Group[1].Jobs[0] {
+		t.Errorf("expected the same path and terraform workspace to share a job")
+	}
+}
+
+func TestTargetRunnerConflictingPlacements(t *testing.T) {
+	tests := map[string]struct {
+		target      *terrallel.Target
+		expectedErr string
+	}{
+		"same settings everywhere": {
+			target: &terrallel.Target{
+				Name: "dev",
+				Env:  map[string]string{"AWS_PROFILE": "dev"},
+				Group: []*terrallel.Target{
+					{
+						Name:       "aws",
+						Workspaces: []terrallel.Workspace{{Path: "shared/network", Vars: map[string]string{"cidr": "10.0.0.0/16"}}},
+					},
+					{
+						Name:       "gcp",
+						Workspaces: []terrallel.Workspace{{Path: "shared/network/", Vars: map[string]string{"cidr": "10.0.0.0/16"}}},
+					},
+				},
+			},
+		},
+		"inherited environment differs": {
+			target: &terrallel.Target{
+				Name: "dev",
+				Group: []*terrallel.Target{
+					{
+						Name:       "aws",
+						Env:        map[string]string{"AWS_PROFILE": "aws"},
+						Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+					},
+					{
+						Name:       "gcp",
+						Env:        map[string]string{"AWS_PROFILE": "gcp"},
+						Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+					},
+				},
+			},
+			expectedErr: "workspace shared/network appears more than once with different settings",
+		},
+		"inherited labels differ": {
+			target: &terrallel.Target{
+				Name:       "dev",
+				Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+				Next: &terrallel.Target{
+					Name:       "next",
+					Labels:     map[string]string{"provider": "aws"},
+					Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+				},
+			},
+			expectedErr: "workspace shared/network appears more than once with different settings",
+		},
+		"own settings differ": {
+			target: &terrallel.Target{
+				Name:               "dev",
+				TerraformWorkspace: "dev",
+				Workspaces: []terrallel.Workspace{
+					{Path: "shared/network", Timeout: time.Minute},
+					{Path: "shared/network", Args: map[string][]string{"plan": {"-refresh=false"}}},
+				},
+			},
+			expectedErr: "workspace shared/network@dev appears more than once with different settings",
+		},
+		"placed before and after another": {
+			target: &terrallel.Target{
+				Name:       "dev",
+				Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+				Next: &terrallel.Target{
+					Name:       "next",
+					Workspaces: []terrallel.Workspace{{Path: "cluster"}},
+					Next: &terrallel.Target{
+						Name:       "last",
+						Workspaces: []terrallel.Workspace{{Path: "shared/network"}},
+					},
+				},
+			},
+			expectedErr: "workspace shared/network depends on itself: it is placed both before and after another workspace in dev",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := tc.target.Runner(func(ws terrallel.Workspace) terrallel.Job {
+				return &namedJob{name: ws.Key()}
+			})
+			actualErr := ""
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if actualErr != tc.expectedErr {
+				t.Errorf("expected error %q, got %q", tc.expectedErr, actualErr)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,11 +17,34 @@ type Terrallel struct {
 }
 
 type Config struct {
-	Basedir string
-	Import  []string
+	Basedir     string
+	Import      []string
+	Parallelism int
+	// Binary is the terraform-compatible program to run, such as tofu or
+	// terragrunt, unless a workspace sets its own.
+	Binary string
+	// PluginCache is a directory every workspace shares as its
+	// TF_PLUGIN_CACHE_DIR.
+	PluginCache string `yaml:"plugin_cache"`
+	// Pools caps how many jobs with a given label value may run at once,
+	// keyed by label name and then label value.
+	Pools map[string]map[string]int
+	// Retry applies to every workspace which doesn't set its own.
+	Retry *Retry
+	// Timeout limits how long a whole run may take.
+	Timeout time.Duration
+	// JobTimeout limits how long each workspace may run unless the
+	// workspace sets its own.
+	JobTimeout time.Duration `yaml:"job_timeout"`
+	// Grace is how long a stopped job has to exit before it is sent SIGTERM
+	// and then SIGKILL. It is nil unless set.
+	Grace *time.Duration
 }
 
 func New(path string) (*Terrallel, error) {
+	if isHCL(path) {
+		return newFromHCL(path)
+	}
 	t := &Terrallel{
 		Manifest: map[string]*Target{},
 		Config:   &Config{},
@@ -43,18 +67,41 @@ func New(path string) (*Terrallel, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parsing imports: %w", err)
 	}
-	for name, target := range unresolved {
-		if resolved, err := target.resolve(unresolved, name, map[string]bool{}); err != nil {
-			return nil, fmt.Errorf("resolving targets: %w", err)
+	if err := t.resolve(unresolved); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Terrallel) resolve(all unresolved) error {
+	for name, target := range all {
+		if resolved, err := target.resolve(all, name, map[string]bool{}); err != nil {
+			return fmt.Errorf("resolving targets: %w", err)
 		} else {
 			t.Manifest[name] = resolved
 		}
 	}
-	return t, nil
+	return nil
 }
 
 func readImports(basedir string, globs []string) ([][]byte, error) {
+	paths, err := importPaths(basedir, globs)
+	if err != nil {
+		return nil, err
+	}
 	var imports [][]byte
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading import %s: %w", path, err)
+		}
+		imports = append(imports, content)
+	}
+	return imports, nil
+}
+
+func importPaths(basedir string, globs []string) ([]string, error) {
+	var all []string
 	for _, pattern := range globs {
 		paths, err := filepath.Glob(path.Join(basedir, pattern))
 		if err != nil {
@@ -66,15 +113,9 @@ func readImports(basedir string, globs []string) ([][]byte, error) {
 				paths = []string{path.Join(basedir, pattern)}
 			}
 		}
-		for _, path := range paths {
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return nil, fmt.Errorf("reading import %s: %w", path, err)
-			}
-			imports = append(imports, content)
-		}
+		all = append(all, paths...)
 	}
-	return imports, nil
+	return all, nil
 }
 
 type unresolved map[string]*target
@@ -90,10 +131,16 @@ func newUnresolved(imports [][]byte) (unresolved, error) {
 		}
 		if temp.Targets != nil {
 			for name, target := range temp.Targets {
-				if _, exists := all[name]; exists {
-					return nil, fmt.Errorf("duplicate: %s", name)
+				expanded, err := target.expand(name)
+				if err != nil {
+					return nil, err
+				}
+				for name, target := range expanded {
+					if _, exists := all[name]; exists {
+						return nil, fmt.Errorf("duplicate: %s", name)
+					}
+					all[name] = target
 				}
-				all[name] = target
 			}
 		}
 	}
@@ -102,9 +149,14 @@ func newUnresolved(imports [][]byte) (unresolved, error) {
 
 type target struct {
 	parent     string
+	Matrix     *matrix
+	Labels     map[string]string
+	Env        map[string]string
 	Group      []string
-	Workspaces []string
+	Workspaces []Workspace
 	Next       *target
+	// TerraformWorkspace may use matrix placeholders to differ per target.
+	TerraformWorkspace string `yaml:"terraform_workspace"`
 }
 
 func (t *target) resolve(targets unresolved, name string, visited map[string]bool) (*Target, error) {
@@ -116,8 +168,11 @@ func (t *target) resolve(targets unresolved, name string, visited map[string]boo
 	}
 	visited[name] = true
 	target := &Target{
-		Name:       name,
-		Workspaces: t.Workspaces,
+		Name:               name,
+		Labels:             t.Labels,
+		Env:                t.Env,
+		Workspaces:         t.Workspaces,
+		TerraformWorkspace: t.TerraformWorkspace,
 	}
 	var err error
 	if len(t.Group) != 0 {
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/scaleoutllc/terrallel/internal/terrallel"
@@ -37,10 +38,10 @@ targets:
 			expected: map[string]*terrallel.Target{
 				"t1": {
 					Name:       "t1",
-					Workspaces: []string{"t1ws1", "t1ws2"},
+					Workspaces: []terrallel.Workspace{{Path: "t1ws1"}, {Path: "t1ws2"}},
 					Next: &terrallel.Target{
 						Name:       "next",
-						Workspaces: []string{"t1ws3"},
+						Workspaces: []terrallel.Workspace{{Path: "t1ws3"}},
 					},
 				},
 			},
@@ -155,6 +156,280 @@ targets:
 			expected:    nil,
 			expectedErr: "recursive loop",
 		},
+		{
+			name: "matrix generates targets with substituted names and paths",
+			manifest: `
+targets:
+  dev-${cloud}-cluster:
+    matrix:
+      cloud: [aws, gcp]
+    workspaces:
+    - dev/${cloud}/k8s
+    next:
+      group:
+      - dev-${cloud}-services
+  dev-aws-services:
+    workspaces:
+    - dev/aws/services
+  dev-gcp-services:
+    workspaces:
+    - dev/gcp/services`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"dev-aws-cluster": {
+					Name:       "dev-aws-cluster",
+					Workspaces: []terrallel.Workspace{{Path: "dev/aws/k8s"}},
+					Next: &terrallel.Target{
+						Name: "next",
+						Group: []*terrallel.Target{
+							{
+								Name:       "dev-aws-services",
+								Workspaces: []terrallel.Workspace{{Path: "dev/aws/services"}},
+							},
+						},
+					},
+				},
+				"dev-gcp-cluster": {
+					Name:       "dev-gcp-cluster",
+					Workspaces: []terrallel.Workspace{{Path: "dev/gcp/k8s"}},
+					Next: &terrallel.Target{
+						Name: "next",
+						Group: []*terrallel.Target{
+							{
+								Name:       "dev-gcp-services",
+								Workspaces: []terrallel.Workspace{{Path: "dev/gcp/services"}},
+							},
+						},
+					},
+				},
+				"dev-aws-services": {
+					Name:       "dev-aws-services",
+					Workspaces: []terrallel.Workspace{{Path: "dev/aws/services"}},
+				},
+				"dev-gcp-services": {
+					Name:       "dev-gcp-services",
+					Workspaces: []terrallel.Workspace{{Path: "dev/gcp/services"}},
+				},
+			},
+		},
+		{
+			name: "matrix without placeholders in the name groups generated targets",
+			manifest: `
+targets:
+  network:
+    matrix:
+      cloud: [aws]
+      region: [us, au]
+      include:
+      - cloud: gcp
+        region: us
+    workspaces:
+    - ${cloud}/${region}/network`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"network": {
+					Name: "network",
+					Group: []*terrallel.Target{
+						{
+							Name:       "network-aws-us",
+							Workspaces: []terrallel.Workspace{{Path: "aws/us/network"}},
+						},
+						{
+							Name:       "network-aws-au",
+							Workspaces: []terrallel.Workspace{{Path: "aws/au/network"}},
+						},
+						{
+							Name:       "network-gcp-us",
+							Workspaces: []terrallel.Workspace{{Path: "gcp/us/network"}},
+						},
+					},
+				},
+				"network-aws-us": {
+					Name:       "network-aws-us",
+					Workspaces: []terrallel.Workspace{{Path: "aws/us/network"}},
+				},
+				"network-aws-au": {
+					Name:       "network-aws-au",
+					Workspaces: []terrallel.Workspace{{Path: "aws/au/network"}},
+				},
+				"network-gcp-us": {
+					Name:       "network-gcp-us",
+					Workspaces: []terrallel.Workspace{{Path: "gcp/us/network"}},
+				},
+			},
+		},
+		{
+			name: "matrix with unknown placeholder",
+			manifest: `
+targets:
+  network:
+    matrix:
+      cloud: [aws]
+    workspaces:
+    - ${cloud}/${region}/network`,
+			imports:     map[string]string{},
+			expected:    nil,
+			expectedErr: "unknown matrix key",
+		},
+		{
+			name: "workspaces as objects with labels",
+			manifest: `
+targets:
+  t1:
+    labels:
+      provider: aws
+    workspaces:
+    - t1ws1
+    - path: t1ws2
+      labels:
+        account: prod`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name:   "t1",
+					Labels: map[string]string{"provider": "aws"},
+					Workspaces: []terrallel.Workspace{
+						{Path: "t1ws1"},
+						{Path: "t1ws2", Labels: map[string]string{"account": "prod"}},
+					},
+				},
+			},
+		},
+		{
+			name: "workspace with retry settings",
+			manifest: `
+terrallel:
+  retry:
+    attempts: 1
+targets:
+  t1:
+    workspaces:
+    - path: t1ws1
+      retry:
+        attempts: 3
+        backoff: 10s
+        match:
+        - Error acquiring the state lock`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name: "t1",
+					Workspaces: []terrallel.Workspace{
+						{Path: "t1ws1", Retry: &terrallel.Retry{
+							Attempts: 3,
+							Backoff:  10 * time.Second,
+							Match:    []string{"Error acquiring the state lock"},
+						}},
+					},
+				},
+			},
+		},
+		{
+			name: "workspace with its own binary",
+			manifest: `
+terrallel:
+  binary: tofu
+targets:
+  t1:
+    workspaces:
+    - t1ws1
+    - path: t1ws2
+      binary: terragrunt`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"t1": {
+					Name: "t1",
+					Workspaces: []terrallel.Workspace{
+						{Path: "t1ws1"},
+						{Path: "t1ws2", Binary: "terragrunt"},
+					},
+				},
+			},
+		},
+		{
+			name: "workspace arguments substituted by matrix",
+			manifest: `
+targets:
+  net-${region}:
+    matrix:
+      region: [us-east-1]
+    workspaces:
+    - path: net/${region}
+      args:
+        plan: [-lock=false]
+      var_files: ["${region}.tfvars"]
+      vars:
+        region: ${region}`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"net-us-east-1": {
+					Name: "net-us-east-1",
+					Workspaces: []terrallel.Workspace{{
+						Path:     "net/us-east-1",
+						Args:     map[string][]string{"plan": {"-lock=false"}},
+						VarFiles: []string{"us-east-1.tfvars"},
+						Vars:     map[string]string{"region": "us-east-1"},
+					}},
+				},
+			},
+		},
+		{
+			name: "environment substituted by matrix",
+			manifest: `
+targets:
+  net-${region}:
+    matrix:
+      region: [us-east-1]
+    env:
+      AWS_REGION: ${region}
+    workspaces:
+    - path: net/${region}
+      env:
+        TF_VAR_region: ${region}`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"net-us-east-1": {
+					Name: "net-us-east-1",
+					Env:  map[string]string{"AWS_REGION": "us-east-1"},
+					Workspaces: []terrallel.Workspace{{
+						Path: "net/us-east-1",
+						Env:  map[string]string{"TF_VAR_region": "us-east-1"},
+					}},
+				},
+			},
+		},
+		{
+			name: "terraform workspace substituted by matrix",
+			manifest: `
+targets:
+  net-${env}:
+    matrix:
+      env: [dev, stage]
+    terraform_workspace: ${env}
+    workspaces:
+    - net
+    - path: dns
+      terraform_workspace: shared`,
+			imports: map[string]string{},
+			expected: map[string]*terrallel.Target{
+				"net-dev": {
+					Name:               "net-dev",
+					TerraformWorkspace: "dev",
+					Workspaces: []terrallel.Workspace{
+						{Path: "net"},
+						{Path: "dns", TerraformWorkspace: "shared"},
+					},
+				},
+				"net-stage": {
+					Name:               "net-stage",
+					TerraformWorkspace: "stage",
+					Workspaces: []terrallel.Workspace{
+						{Path: "net"},
+						{Path: "dns", TerraformWorkspace: "shared"},
+					},
+				},
+			},
+		},
 		{
 			name: "valid with imports",
 			manifest: `
@@ -189,28 +464,28 @@ targets:
 			expected: map[string]*terrallel.Target{
 				"t1": {
 					Name:       "t1",
-					Workspaces: []string{"t1ws1", "t1ws2"},
+					Workspaces: []terrallel.Workspace{{Path: "t1ws1"}, {Path: "t1ws2"}},
 					Next: &terrallel.Target{
 						Name:       "next",
-						Workspaces: []string{"t1ws3"},
+						Workspaces: []terrallel.Workspace{{Path: "t1ws3"}},
 					},
 				},
 				"t2": {
 					Name:       "t2",
-					Workspaces: []string{"t2ws1", "t2ws2"},
+					Workspaces: []terrallel.Workspace{{Path: "t2ws1"}, {Path: "t2ws2"}},
 					Next: &terrallel.Target{
 						Name: "next",
 						Group: []*terrallel.Target{
 							{
 								Name:       "t3",
-								Workspaces: []string{"t3ws1", "t3ws2"},
+								Workspaces: []terrallel.Workspace{{Path: "t3ws1"}, {Path: "t3ws2"}},
 							},
 						},
 					},
 				},
 				"t3": {
 					Name:       "t3",
-					Workspaces: []string{"t3ws1", "t3ws2"},
+					Workspaces: []terrallel.Workspace{{Path: "t3ws1"}, {Path: "t3ws2"}},
 				},
 			},
 		},
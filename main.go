@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/scaleoutllc/terrallel/internal/cli"
@@ -13,25 +14,32 @@ import (
 
 func main() {
 	var manifestPath string
-	var dryRun bool
+	var opts cli.Options
 	var rootCmd = &cobra.Command{
 		Use:   "terrallel",
 		Short: "run terraform in parallel across dependent workspaces",
+		Args:  cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			dashIndex := cmd.ArgsLenAtDash()
 			if len(args) == 0 || dashIndex == 0 {
-				return errors.New("no target specified")
+				return errors.New("no target specified: a target is required, even with --from, --to, --with-deps or --with-dependents")
 			}
 			if dashIndex == -1 || strings.TrimSpace(strings.Join(args[dashIndex:], "")) == "" {
 				return errors.New("no terraform command defined after `--`")
 			}
-			return cli.Root(manifestPath, args[0], args[dashIndex:], dryRun)
+			return cli.Root(manifestPath, args[0], args[dashIndex:], opts)
 		},
 	}
 	rootCmd.SilenceErrors = true
 	rootCmd.SilenceUsage = true
 	rootCmd.SetUsageTemplate(`Usage:
   terrallel [-cd] <target> -- <terraform-command>
+  terrallel <target> --with-deps <workspace> -- <terraform-command>
+  terrallel retry-failed
+  terrallel plan <target> [-- <plan-flags>]
+  terrallel apply <target> --plan-dir <dir> [-- <apply-flags>]
+  terrallel drift <target> [--json <file>]
+  terrallel exec <target> -- <command>
 
 Flags:
 {{.Flags.FlagUsages | trimTrailingWhitespaces}}
@@ -39,15 +47,138 @@ Flags:
 Example:
   terrallel network -- init
   terrallel network -- apply -auto-approve
-  terrallel network -- destroy -auto-approve`)
-	rootCmd.Flags().StringVarP(&manifestPath, "manifest", "m", "Infrafile", "Path to the manifest file")
-	rootCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Enable dry-run mode")
+  terrallel network -- destroy -auto-approve
+  terrallel network --with-deps network/vpc -- apply
+  terrallel retry-failed
+  terrallel plan network
+  terrallel apply network --plan-dir .terrallel/plans/network-20240101-120000
+  terrallel drift network
+  terrallel network --bin tofu -- plan
+  terrallel exec network -- tflint --recursive`)
+	flags := rootCmd.PersistentFlags()
+	flags.StringVarP(&manifestPath, "manifest", "m", "Infrafile", "Path to the manifest file")
+	flags.BoolVarP(&opts.DryRun, "dry-run", "d", false, "Enable dry-run mode")
+	flags.BoolVarP(&opts.KeepGoing, "keep-going", "k", false, "Keep running everything that does not depend on a failed job")
+	flags.BoolVar(&opts.FailFast, "fail-fast", false, "Interrupt every running job as soon as any job fails")
+	flags.IntVarP(&opts.Parallelism, "parallelism", "p", 0, "Maximum number of jobs to run at once (0 is unlimited)")
+	flags.StringVar(&opts.Bin, "bin", "", "Terraform-compatible program to run, such as tofu or terragrunt (default terraform)")
+	flags.StringVar(&opts.PluginCache, "plugin-cache", "", "Directory every workspace shares as TF_PLUGIN_CACHE_DIR")
+	flags.BoolVar(&opts.AutoInit, "auto-init", false, "Run init first in workspaces which are not initialised or out of date")
+	flags.DurationVar(&opts.Timeout, "timeout", 0, "Stop the whole run after this long (e.g. 2h)")
+	flags.DurationVar(&opts.JobTimeout, "job-timeout", 0, "Stop any workspace which runs longer than this (e.g. 30m)")
+	var grace time.Duration
+	flags.DurationVar(&grace, "grace", 0, "How long a stopped job has to exit before SIGTERM and then SIGKILL, 0 never (default 30s for timed out jobs only)")
+	rootCmd.Flags().BoolVar(&opts.Resume, "resume", false, "Skip workspaces which succeeded in the last run of the same target and command")
+	flags.BoolVar(&opts.Reverse, "reverse", false, "Run in teardown order whatever the terraform command")
+	flags.BoolVar(&opts.Forward, "forward", false, "Run in build order whatever the terraform command")
+	flags.StringVar(&opts.From, "from", "", "Run only this workspace or target of the target being run and everything after it")
+	flags.StringVar(&opts.To, "to", "", "Run only this workspace or target of the target being run and everything before it")
+	flags.StringVar(&opts.WithDeps, "with-deps", "", "Run only this workspace or target of the target being run and everything it depends on")
+	flags.StringVar(&opts.WithDependents, "with-dependents", "", "Run only this workspace or target of the target being run and everything depending on it")
+	flags.StringSliceVar(&opts.OnlyGlobs, "only", nil, "Run only workspaces whose path matches this glob (repeatable)")
+	flags.StringSliceVar(&opts.ExcludeGlobs, "exclude", nil, "Exclude workspaces whose path matches this glob (repeatable)")
+	flags.StringSliceVar(&opts.LabelSelectors, "select", nil, "Run only workspaces with this label, written as key=value (repeatable)")
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if cmd.Flags().Changed("grace") {
+			opts.Grace = &grace
+		}
+	}
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "retry-failed",
+		Short: "rerun the workspaces which did not succeed in the last run",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cli.RetryFailed(manifestPath, opts)
+		},
+	})
+	var planDir string
+	planCmd := &cobra.Command{
+		Use:   "plan <target> [-- <plan-flags>]",
+		Short: "save a plan for every workspace of a target",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, extra, err := subcommandArgs(cmd, args)
+			if err != nil {
+				return err
+			}
+			return cli.Plan(manifestPath, target, extra, planDir, opts)
+		},
+	}
+	planCmd.Flags().StringVar(&planDir, "plan-dir", "", "Directory to save plans in (default .terrallel/plans/<target>-<time>)")
+	applyCmd := &cobra.Command{
+		Use:   "apply <target> --plan-dir <dir> [-- <apply-flags>]",
+		Short: "apply the plans saved for a target",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, extra, err := subcommandArgs(cmd, args)
+			if err != nil {
+				return err
+			}
+			return cli.Apply(manifestPath, target, extra, planDir, opts)
+		},
+	}
+	applyCmd.Flags().StringVar(&planDir, "plan-dir", "", "Directory the plans were saved in")
+	applyCmd.MarkFlagRequired("plan-dir")
+	var driftJSON string
+	driftCmd := &cobra.Command{
+		Use:   "drift <target> [-- <plan-flags>]",
+		Short: "report resources changed outside of terraform in every workspace of a target",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, extra, err := subcommandArgs(cmd, args)
+			if err != nil {
+				return err
+			}
+			return cli.Drift(manifestPath, target, extra, driftJSON, opts)
+		},
+	}
+	driftCmd.Flags().StringVar(&driftJSON, "json", "", "Where to write the drift report as JSON (default .terrallel/drift/<target>-<time>/drift.json)")
+	execCmd := &cobra.Command{
+		Use:   "exec <target> -- <command>",
+		Short: "run any command in every workspace of a target in dependency order",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, command, err := subcommandArgs(cmd, args)
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(strings.Join(command, "")) == "" {
+				return errors.New("no command defined after `--`")
+			}
+			return cli.Exec(manifestPath, target, command, opts)
+		},
+	}
+	rootCmd.AddCommand(planCmd, applyCmd, driftCmd, execCmd)
 	if err := rootCmd.Execute(); err != nil {
+		// like terraform with -detailed-exitcode, 2 means success with changes,
+		// so it is never used when anything else went wrong too.
+		if err == cli.ErrChanges {
+			os.Exit(2)
+		}
 		fmt.Println(errorBar(err))
 		os.Exit(1)
 	}
 }
 
+// subcommandArgs splits the arguments of a subcommand into the target and
+// any terraform flags given after `--`.
+func subcommandArgs(cmd *cobra.Command, args []string) (string, []string, error) {
+	dashIndex := cmd.ArgsLenAtDash()
+	if dashIndex == 0 {
+		return "", nil, errors.New("no target specified")
+	}
+	if dashIndex == -1 {
+		if len(args) != 1 {
+			return "", nil, errors.New("terraform flags must be given after `--`")
+		}
+		return args[0], nil, nil
+	}
+	if dashIndex != 1 {
+		return "", nil, errors.New("only one target may be specified")
+	}
+	return args[0], args[dashIndex:], nil
+}
+
 func errorBar(err error) string {
 	prefix := color.RedString("│ ")
 	lines := strings.Split(err.Error(), "\n")